@@ -0,0 +1,28 @@
+//go:build linux
+
+package common
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+/*
+Clock source reading the status of the kernel clock, which is kept up to date by
+the NTP or PTP daemon (ntpd, chronyd, ptp4l with phc2sys).
+*/
+type KernelClock struct{}
+
+func (c KernelClock) GetClockStatus() (*ClockStatus, error) {
+	// no mode bits set, the kernel clock is only read
+	timex := unix.Timex{}
+	_, err := unix.Adjtimex(&timex)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClockStatus{
+		Synchronized: timex.Status&unix.STA_UNSYNC == 0,
+		MaxError:     time.Duration(timex.Maxerror) * time.Microsecond,
+	}, nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package common
+
+import (
+	"errors"
+)
+
+/*
+Clock source reading the status of the kernel clock. It is only available on
+Linux.
+*/
+type KernelClock struct{}
+
+func (c KernelClock) GetClockStatus() (*ClockStatus, error) {
+	return nil, errors.New("Kernel clock status is only available on Linux.")
+}
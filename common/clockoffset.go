@@ -0,0 +1,270 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+The results are split into clockWindows to twice as many windows, the
+minimum-delay sample of each is used to estimate the clock offset and drift.
+*/
+const clockWindows = 16
+
+/*
+Clock offset of the reflector from the sender measured by the minimum-delay test
+packet of a part of the run.
+*/
+type OffsetSample struct {
+	// Sender timestamp of the test packet
+	Time time.Time `json:"time"`
+	// NTP-style offset and delay of the test packet
+	Offset time.Duration `json:"offset"`
+	Delay  time.Duration `json:"delay"`
+	// Offset estimated at the time of the test packet
+	Estimated time.Duration `json:"estimated"`
+}
+
+/*
+Offset of the reflector clock from the sender clock over a test run: the offset
+at the reference time and its drift (skew) in seconds per second.
+*/
+type ClockEstimate struct {
+	Reference time.Time     `json:"reference"`
+	Offset    time.Duration `json:"offset"`
+	Skew      float64       `json:"skew"`
+	// Number of minimum-delay samples the estimate is based on
+	Samples int `json:"samples"`
+}
+
+/*
+Average and standard deviation of a one-way delay corrected by the estimated
+clock offset.
+*/
+type CorrectedDelayStats struct {
+	Avg    time.Duration `json:"avg"`
+	StdDev time.Duration `json:"stddev"`
+}
+
+/*
+Format the statistics as avg/stddev in milliseconds.
+*/
+func (s CorrectedDelayStats) String() string {
+	return fmt.Sprintf("%0.3f/%0.3f ms",
+		(float64(s.Avg) / float64(time.Millisecond)),
+		(float64(s.StdDev) / float64(time.Millisecond)),
+	)
+}
+
+/*
+Get the NTP-style offset of the reflector clock from the sender clock measured by
+the test packet. Its error is at most half the network round-trip time.
+*/
+func (r *TwampResult) GetClockOffset() time.Duration {
+	return (r.GetForwardDelay() - r.GetReverseDelay()) / 2
+}
+
+/*
+Get the forward delay corrected by the estimated clock offset.
+*/
+func (r *TwampResult) GetCorrectedForwardDelay(e *ClockEstimate) time.Duration {
+	return r.GetForwardDelay() - e.GetOffset(r.SenderTimestamp)
+}
+
+/*
+Get the reverse delay corrected by the estimated clock offset.
+*/
+func (r *TwampResult) GetCorrectedReverseDelay(e *ClockEstimate) time.Duration {
+	return r.GetReverseDelay() + e.GetOffset(r.SenderTimestamp)
+}
+
+/*
+Get the estimated offset of the reflector clock at the given sender time.
+*/
+func (e *ClockEstimate) GetOffset(t time.Time) time.Duration {
+	return e.Offset + time.Duration(e.Skew*float64(t.Sub(e.Reference)))
+}
+
+/*
+Format the estimate with the offset in milliseconds and the drift in ppm.
+*/
+func (e *ClockEstimate) String() string {
+	return fmt.Sprintf("offset %0.3f ms, drift %0.3f ppm",
+		(float64(e.Offset) / float64(time.Millisecond)),
+		e.Skew*1e6,
+	)
+}
+
+/*
+Minimum-delay sample of a window of results.
+*/
+type clockSample struct {
+	time   time.Time
+	offset time.Duration
+	delay  time.Duration
+}
+
+/*
+Online means and co-moments of the one-way delays and of their time since the
+reference (Welford's algorithm). As the correction by the clock offset is linear
+in time, the average and standard deviation of the corrected delays follow from
+them once the offset and drift are estimated.
+*/
+type correctionSums struct {
+	count   int
+	time    float64 // mean time since the reference
+	forward float64 // mean forward delay
+	reverse float64 // mean reverse delay
+	m2Time  float64
+	m2Fwd   float64
+	m2Rev   float64
+	coFwd   float64 // co-moment of the time and the forward delay
+	coRev   float64 // co-moment of the time and the reverse delay
+}
+
+func (s *correctionSums) add(t float64, forward float64, reverse float64) {
+	s.count++
+	n := float64(s.count)
+
+	dt := t - s.time
+	s.time += dt / n
+	dForward := forward - s.forward
+	s.forward += dForward / n
+	dReverse := reverse - s.reverse
+	s.reverse += dReverse / n
+
+	s.m2Time += dt * (t - s.time)
+	s.m2Fwd += dForward * (forward - s.forward)
+	s.m2Rev += dReverse * (reverse - s.reverse)
+	s.coFwd += dt * (forward - s.forward)
+	s.coRev += dt * (reverse - s.reverse)
+}
+
+/*
+Get the statistics of the delays corrected by the offset a+b*t: forward - a - b*t
+and reverse + a + b*t.
+*/
+func (s *correctionSums) corrected(e *ClockEstimate) (CorrectedDelayStats, CorrectedDelayStats) {
+	a := float64(e.Offset)
+	b := e.Skew
+
+	forward := CorrectedDelayStats{Avg: time.Duration(s.forward - a - b*s.time)}
+	reverse := CorrectedDelayStats{Avg: time.Duration(s.reverse + a + b*s.time)}
+	if s.count > 1 {
+		n := float64(s.count - 1)
+		m2Forward := s.m2Fwd - 2*b*s.coFwd + b*b*s.m2Time
+		m2Reverse := s.m2Rev + 2*b*s.coRev + b*b*s.m2Time
+		forward.StdDev = time.Duration(math.Sqrt(math.Max(m2Forward, 0) / n))
+		reverse.StdDev = time.Duration(math.Sqrt(math.Max(m2Reverse, 0) / n))
+	}
+
+	return forward, reverse
+}
+
+/*
+Online estimation of the clock offset and drift. The minimum-delay sample of
+every window of results is kept. When there are twice clockWindows windows, the
+neighbouring windows are merged and the windows get twice as large, so the
+memory is bounded whatever the number of results.
+*/
+type clockEstimator struct {
+	reference time.Time
+	window    int // results per window
+	count     int // results in the last window
+	minimums  []clockSample
+	sums      correctionSums
+}
+
+func (c *clockEstimator) add(r *TwampResult) {
+	sample := clockSample{
+		time:   r.SenderTimestamp,
+		offset: r.GetClockOffset(),
+		delay:  r.GetNetworkRTT(),
+	}
+
+	if len(c.minimums) == 0 {
+		c.reference = sample.time
+		c.window = 1
+	}
+	c.sums.add(float64(sample.time.Sub(c.reference)), float64(r.GetForwardDelay()), float64(r.GetReverseDelay()))
+
+	if len(c.minimums) == 0 || c.count == c.window {
+		if len(c.minimums) == 2*clockWindows {
+			for i := 0; i < clockWindows; i++ {
+				c.minimums[i] = c.minimums[2*i]
+				if c.minimums[2*i+1].delay < c.minimums[i].delay {
+					c.minimums[i] = c.minimums[2*i+1]
+				}
+			}
+			c.minimums = c.minimums[:clockWindows]
+			c.window *= 2
+		}
+
+		c.minimums = append(c.minimums, sample)
+		c.count = 1
+		return
+	}
+
+	c.count++
+	if sample.delay < c.minimums[len(c.minimums)-1].delay {
+		c.minimums[len(c.minimums)-1] = sample
+	}
+}
+
+/*
+Estimate the offset and drift by linear regression over the minimum-delay
+samples, which have the smallest offset error. It returns nil without samples.
+*/
+func (c *clockEstimator) estimate() *ClockEstimate {
+	if len(c.minimums) == 0 {
+		return nil
+	}
+
+	e := &ClockEstimate{Reference: c.reference, Samples: len(c.minimums)}
+
+	// least squares of the offset over the time since the reference, in seconds
+	var sumX, sumY, sumXX, sumXY float64
+	n := float64(len(c.minimums))
+	for _, sample := range c.minimums {
+		x := sample.time.Sub(e.Reference).Seconds()
+		y := sample.offset.Seconds()
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+
+	denominator := n*sumXX - sumX*sumX
+	if denominator != 0 {
+		e.Skew = (n*sumXY - sumX*sumY) / denominator
+	}
+	e.Offset = time.Duration((sumY - e.Skew*sumX) / n * float64(time.Second))
+
+	return e
+}
+
+/*
+Estimate the clock offset and drift of the reflector over all received test
+packets, with the offset time series of the minimum-delay samples and the
+corrected one-way delay statistics.
+*/
+func (r *PingResults) UpdateClockEstimate() {
+	r.Clock = r.Stat.clock.estimate()
+	r.Offsets = nil
+	r.Stat.CorrectedForward = CorrectedDelayStats{}
+	r.Stat.CorrectedReverse = CorrectedDelayStats{}
+	if r.Clock == nil {
+		return
+	}
+
+	for _, sample := range r.Stat.clock.minimums {
+		r.Offsets = append(r.Offsets, OffsetSample{
+			Time:      sample.time,
+			Offset:    sample.offset,
+			Delay:     sample.delay,
+			Estimated: r.Clock.GetOffset(sample.time),
+		})
+	}
+	r.Stat.CorrectedForward, r.Stat.CorrectedReverse = r.Stat.clock.sums.corrected(r.Clock)
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestResultClockOffset(t *testing.T) {
+	tests := []struct {
+		name    string
+		forward time.Duration
+		reverse time.Duration
+		offset  time.Duration
+	}{
+		{"synchronized", 10 * time.Millisecond, 10 * time.Millisecond, 0},
+		{"reflector ahead", 12 * time.Millisecond, 8 * time.Millisecond, 2 * time.Millisecond},
+		{"reflector behind", -5 * time.Millisecond, 25 * time.Millisecond, -15 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		r := newTestResult(1, time.Unix(1700000000, 0), test.forward, time.Millisecond, test.reverse)
+		if offset := r.GetClockOffset(); offset != test.offset {
+			t.Errorf("%s: offset %s, expected %s", test.name, offset, test.offset)
+		}
+	}
+}
+
+func TestClockEstimate(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset time.Duration
+		skew   float64
+	}{
+		{"synchronized", 0, 0},
+		{"offset", 5 * time.Millisecond, 0},
+		{"negative offset", -20 * time.Millisecond, 0},
+		{"drift", time.Millisecond, 50e-6},
+		{"negative drift", 0, -100e-6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(1))
+			start := time.Unix(1700000000, 0)
+			offset := func(sent time.Time) time.Duration {
+				return test.offset + time.Duration(test.skew*float64(sent.Sub(start)))
+			}
+
+			// 10 ms one-way delays with up to 5 ms of queueing, every 100th test
+			// packet is not queued and gives the exact offset
+			results, truth := []*TwampResult{}, []*TwampResult{}
+			for i := 0; i < 10000; i++ {
+				sent := start.Add(time.Duration(i) * 10 * time.Millisecond)
+				f, r := 10*time.Millisecond, 10*time.Millisecond
+				if i%100 != 0 {
+					f += time.Duration(random.Int63n(int64(5 * time.Millisecond)))
+					r += time.Duration(random.Int63n(int64(5 * time.Millisecond)))
+				}
+
+				// the reflector timestamps are taken by its clock
+				results = append(results, newTestResult(uint32(i), sent, f+offset(sent), 50*time.Microsecond, r-offset(sent)))
+				truth = append(truth, newTestResult(uint32(i), sent, f, 50*time.Microsecond, r))
+			}
+
+			pr := countResults(results)
+			e := pr.Clock
+			if e == nil {
+				t.Fatal("no clock estimate")
+			}
+			if !near(e.Offset, test.offset, time.Microsecond) || math.Abs(e.Skew-test.skew) > 1e-9 {
+				t.Errorf("estimated %s, expected offset %s and drift %0.3f ppm", e, test.offset, test.skew*1e6)
+			}
+			if len(pr.Offsets) == 0 || len(pr.Offsets) != e.Samples {
+				t.Errorf("%d offset samples, estimate of %d", len(pr.Offsets), e.Samples)
+			}
+
+			corrected := results[5000]
+			if delay := corrected.GetCorrectedForwardDelay(e); !near(delay, corrected.GetForwardDelay()-offset(corrected.SenderTimestamp), time.Microsecond) {
+				t.Errorf("corrected forward delay %s", delay)
+			}
+
+			stats := pr.Stat
+			expected := countResults(truth).Stat
+			if !near(stats.CorrectedForward.Avg, expected.Forward.Avg, 10*time.Microsecond) || !near(stats.CorrectedForward.StdDev, expected.Forward.StdDev, 10*time.Microsecond) {
+				t.Errorf("corrected forward delay %s, expected %s", stats.CorrectedForward, expected.Forward)
+			}
+			if !near(stats.CorrectedReverse.Avg, expected.Reverse.Avg, 10*time.Microsecond) || !near(stats.CorrectedReverse.StdDev, expected.Reverse.StdDev, 10*time.Microsecond) {
+				t.Errorf("corrected reverse delay %s, expected %s", stats.CorrectedReverse, expected.Reverse)
+			}
+		})
+	}
+}
+
+func TestClockEstimateWithoutResults(t *testing.T) {
+	if e := countResults(nil).Clock; e != nil {
+		t.Errorf("estimated %s without results", e)
+	}
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+/*
+Loss threshold of the test packets of sessions without a Timeout.
+*/
+const DefaultTimeout = 2 * time.Second
+
+/*
+Error of a test packet whose reflected packet did not arrive within the session
+Timeout (loss threshold, RFC 4656 section 3.5).
+*/
+type LostPacketError struct {
+	Sequence uint32
+	Timeout  time.Duration
+}
+
+func (e *LostPacketError) Error() string {
+	return fmt.Sprintf("Test packet %d lost: no reflected packet within %s.", e.Sequence, e.Timeout)
+}
+
+/*
+Check whether an error of a test run is a lost test packet.
+*/
+func IsLost(err error) bool {
+	var lost *LostPacketError
+	return errors.As(err, &lost)
+}
+
+/*
+Read a packet like ReadWithInfo, but give up at the deadline. A missed deadline
+is reported as a LostPacketError of the given Sequence Number.
+*/
+func ReadWithDeadline(conn *net.UDPConn, buf []byte, deadline time.Time, sequence uint32, timeout time.Duration) (int, PacketInfo, *net.UDPAddr, error) {
+	err := conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, PacketInfo{TTL: -1, TOS: -1}, nil, err
+	}
+
+	n, info, addr, err := ReadWithInfo(conn, buf)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, info, addr, &LostPacketError{Sequence: sequence, Timeout: timeout}
+	}
+
+	return n, info, addr, err
+}
+
+/*
+Check whether a reflected packet belongs to a test packet sent before the
+expected one, i.e. it arrived after the loss threshold of its test packet.
+Sequence Numbers wrap around.
+*/
+func IsLate(senderSequence uint32, expected uint32) bool {
+	return int32(senderSequence-expected) < 0
+}
@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsLate(t *testing.T) {
+	tests := []struct {
+		sequence uint32
+		expected uint32
+		late     bool
+	}{
+		{1, 2, true},
+		{2, 2, false},
+		{3, 2, false},
+		// Sequence Numbers wrap around
+		{0xffffffff, 0, true},
+		{0, 0xffffffff, false},
+	}
+
+	for _, test := range tests {
+		if late := IsLate(test.sequence, test.expected); late != test.late {
+			t.Errorf("%d late when %d is expected: %v, expected %v", test.sequence, test.expected, late, test.late)
+		}
+	}
+}
+
+func TestReadWithDeadline(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	start := time.Now()
+	_, _, _, err = ReadWithDeadline(conn, buf, start.Add(20*time.Millisecond), 7, time.Second)
+
+	var lost *LostPacketError
+	if !IsLost(err) || !errors.As(err, &lost) || lost.Sequence != 7 || lost.Timeout != time.Second {
+		t.Fatalf("error %v, expected test packet 7 lost", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("gave up after %s, before the deadline", elapsed)
+	}
+
+	sender, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("reflected"))
+
+	n, _, _, err := ReadWithDeadline(conn, buf, time.Now().Add(time.Second), 8, time.Second)
+	if err != nil || string(buf[:n]) != "reflected" {
+		t.Errorf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestLossThreshold(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    TwampSessionConfig
+		threshold time.Duration
+	}{
+		{"default", TwampSessionConfig{}, DefaultTimeout},
+		{"seconds", TwampSessionConfig{Timeout: 3}, 3 * time.Second},
+		{"sub-second", TwampSessionConfig{Timeout: 3, TimeoutDuration: 250 * time.Millisecond}, 250 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		if threshold := test.config.GetLossThreshold(); threshold != test.threshold {
+			t.Errorf("%s: loss threshold %s, expected %s", test.name, threshold, test.threshold)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+Minimum, average, maximum and standard deviation of a delay.
+*/
+type DelayStats struct {
+	Min    time.Duration `json:"min"`
+	Max    time.Duration `json:"max"`
+	Avg    time.Duration `json:"avg"`
+	StdDev time.Duration `json:"stddev"`
+	count  int
+	mean   float64
+	m2     float64
+}
+
+/*
+Add a delay. The average and the standard deviation are updated online with
+Welford's algorithm, without keeping the delays.
+*/
+func (s *DelayStats) add(delay time.Duration) {
+	if s.count == 0 || s.Min > delay {
+		s.Min = delay
+	}
+	if s.count == 0 || s.Max < delay {
+		s.Max = delay
+	}
+
+	s.count++
+	difference := float64(delay) - s.mean
+	s.mean += difference / float64(s.count)
+	s.m2 += difference * (float64(delay) - s.mean)
+
+	s.Avg = time.Duration(s.mean)
+	if s.count > 1 {
+		s.StdDev = time.Duration(math.Sqrt(s.m2 / float64(s.count-1)))
+	}
+}
+
+/*
+Format the statistics as min/avg/max/stddev in milliseconds.
+*/
+func (s DelayStats) String() string {
+	return fmt.Sprintf("%0.3f/%0.3f/%0.3f/%0.3f ms",
+		(float64(s.Min) / float64(time.Millisecond)),
+		(float64(s.Avg) / float64(time.Millisecond)),
+		(float64(s.Max) / float64(time.Millisecond)),
+		(float64(s.StdDev) / float64(time.Millisecond)),
+	)
+}
+
+/*
+Get the delay of the test packet from the sender to the reflector. It is only
+accurate when the clocks of both are synchronized.
+*/
+func (r *TwampResult) GetForwardDelay() time.Duration {
+	return r.ReceiveTimestamp.Sub(r.SenderTimestamp)
+}
+
+/*
+Get the delay of the reflected packet from the reflector to the sender. It is only
+accurate when the clocks of both are synchronized.
+*/
+func (r *TwampResult) GetReverseDelay() time.Duration {
+	return r.FinishedTimestamp.Sub(r.Timestamp)
+}
+
+/*
+Get the round-trip time spent in the network: the RTT without the time the test
+packet spent in the reflector. It does not depend on clock synchronization.
+*/
+func (r *TwampResult) GetNetworkRTT() time.Duration {
+	return r.GetRTT() - r.GetWait()
+}
+
+/*
+Count the one-way delays, the reflector processing time and the network RTT of a
+received test packet, with their variations, percentiles and histograms and the
+clock offset of the reflector. Duplicates are not counted.
+*/
+func (s *PingResultStats) CountDelays(r *TwampResult) {
+	if r.Duplicate {
+		return
+	}
+
+	if s.rttDelays.histogram.Counts == nil {
+		s.forwardDelays.histogram = newHistogram(s.getHistogramBounds())
+		s.reverseDelays.histogram = newHistogram(s.getHistogramBounds())
+		s.rttDelays.histogram = newHistogram(s.getHistogramBounds())
+	}
+
+	s.Forward.add(r.GetForwardDelay())
+	s.Reverse.add(r.GetReverseDelay())
+	s.Processing.add(r.GetWait())
+	s.NetworkRTT.add(r.GetNetworkRTT())
+
+	s.forwardDelays.add(r.GetForwardDelay())
+	s.reverseDelays.add(r.GetReverseDelay())
+	s.rttDelays.add(r.GetRTT())
+	s.countIPDV(r)
+	s.clock.add(r)
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Result of a test packet sent at the given time, with its one-way delays and the
+time it spent in the reflector.
+*/
+func newTestResult(sequence uint32, sent time.Time, forward time.Duration, wait time.Duration, reverse time.Duration) *TwampResult {
+	return &TwampResult{
+		SeqNum:            sequence,
+		SenderSeqNum:      sequence,
+		SenderTimestamp:   sent,
+		ReceiveTimestamp:  sent.Add(forward),
+		Timestamp:         sent.Add(forward + wait),
+		FinishedTimestamp: sent.Add(forward + wait + reverse),
+	}
+}
+
+/*
+Count the results in the statistics of a test run, in the given arrival order.
+*/
+func countResults(results []*TwampResult) *PingResults {
+	r := &PingResults{Stat: NewPingResultStats(nil, nil)}
+	for _, result := range results {
+		r.Stat.Count(result)
+		r.AddResult(result, KeepAllResults)
+	}
+	r.UpdateStats()
+	return r
+}
+
+/*
+Check whether a delay is within the tolerance of the expected one.
+*/
+func near(delay time.Duration, expected time.Duration, tolerance time.Duration) bool {
+	difference := delay - expected
+	return difference <= tolerance && difference >= -tolerance
+}
+
+func TestOneWayDelays(t *testing.T) {
+	tests := []struct {
+		name    string
+		forward time.Duration
+		wait    time.Duration
+		reverse time.Duration
+	}{
+		{"symmetric", 10 * time.Millisecond, 50 * time.Microsecond, 10 * time.Millisecond},
+		{"asymmetric", 3 * time.Millisecond, time.Millisecond, 25 * time.Millisecond},
+		// the reflector clock is behind the sender clock
+		{"negative forward delay", -2 * time.Millisecond, 0, 12 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestResult(1, time.Unix(1700000000, 0), test.forward, test.wait, test.reverse)
+
+			if delay := r.GetForwardDelay(); delay != test.forward {
+				t.Errorf("forward delay %s, expected %s", delay, test.forward)
+			}
+			if delay := r.GetReverseDelay(); delay != test.reverse {
+				t.Errorf("reverse delay %s, expected %s", delay, test.reverse)
+			}
+			if wait := r.GetWait(); wait != test.wait {
+				t.Errorf("reflector time %s, expected %s", wait, test.wait)
+			}
+			if rtt := r.GetRTT(); rtt != test.forward+test.wait+test.reverse {
+				t.Errorf("RTT %s, expected %s", rtt, test.forward+test.wait+test.reverse)
+			}
+			if rtt := r.GetNetworkRTT(); rtt != test.forward+test.reverse {
+				t.Errorf("network RTT %s, expected %s", rtt, test.forward+test.reverse)
+			}
+		})
+	}
+}
+
+func TestDelayStats(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	results := []*TwampResult{}
+	for i := 1; i <= 4; i++ {
+		delay := time.Duration(i) * time.Millisecond
+		results = append(results, newTestResult(uint32(i), start.Add(delay), delay, 100*time.Microsecond, 2*delay))
+	}
+
+	// duplicates are not counted
+	duplicate := newTestResult(1, start, time.Second, time.Second, time.Second)
+	duplicate.Duplicate = true
+	results = append(results, duplicate)
+
+	stats := countResults(results).Stat
+
+	// sample standard deviation of 1, 2, 3 and 4 ms is 1.291 ms
+	tests := []struct {
+		name     string
+		stats    DelayStats
+		expected DelayStats
+	}{
+		{"forward", stats.Forward, DelayStats{Min: time.Millisecond, Max: 4 * time.Millisecond, Avg: 2500 * time.Microsecond, StdDev: 1290994 * time.Nanosecond}},
+		{"reverse", stats.Reverse, DelayStats{Min: 2 * time.Millisecond, Max: 8 * time.Millisecond, Avg: 5 * time.Millisecond, StdDev: 2581989 * time.Nanosecond}},
+		{"processing", stats.Processing, DelayStats{Min: 100 * time.Microsecond, Max: 100 * time.Microsecond, Avg: 100 * time.Microsecond}},
+		{"network RTT", stats.NetworkRTT, DelayStats{Min: 3 * time.Millisecond, Max: 12 * time.Millisecond, Avg: 7500 * time.Microsecond, StdDev: 3872983 * time.Nanosecond}},
+	}
+
+	for _, test := range tests {
+		s, e := test.stats, test.expected
+		if s.Min != e.Min || s.Max != e.Max || !near(s.Avg, e.Avg, time.Microsecond) || !near(s.StdDev, e.StdDev, time.Microsecond) {
+			t.Errorf("%s delay %s, expected %s", test.name, s, e)
+		}
+	}
+}
+
+func TestNegativeDelayStats(t *testing.T) {
+	// the reflector clock is far behind the sender clock
+	var stats DelayStats
+	for _, delay := range []time.Duration{-3 * time.Millisecond, -time.Millisecond, -2 * time.Millisecond} {
+		stats.add(delay)
+	}
+	if stats.Min != -3*time.Millisecond || stats.Max != -time.Millisecond || stats.Avg != -2*time.Millisecond {
+		t.Errorf("delay %s, expected -3/-2/-1 ms min/avg/max", stats)
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Percentiles reported in the statistics when the session configures none.
+*/
+var defaultPercentiles = []float64{50, 90, 95, 99, 99.9}
+
+/*
+Upper bounds of the histogram buckets when the session configures none. Delays
+above the last bound are counted in an overflow bucket.
+*/
+var defaultHistogramBounds = []time.Duration{
+	100 * time.Microsecond,
+	200 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+/*
+Bucketed histogram: Counts[i] delays are at most Bounds[i] and above the previous
+bound, the last count is of the delays above the last bound.
+*/
+type Histogram struct {
+	Bounds []time.Duration `json:"bounds"`
+	Counts []int           `json:"counts"`
+}
+
+/*
+Percentiles and histogram of a delay.
+*/
+type Distribution struct {
+	Percentiles map[string]time.Duration `json:"percentiles"`
+	Histogram   Histogram                `json:"histogram"`
+}
+
+/*
+Name of a percentile in the statistics, for example p99 or p99.9.
+*/
+func percentileName(p float64) string {
+	return "p" + strconv.FormatFloat(p, 'f', -1, 64)
+}
+
+/*
+Get the percentile of a name in the statistics.
+*/
+func percentileOfName(name string) float64 {
+	p, _ := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+	return p
+}
+
+/*
+Format percentiles as their names and values in milliseconds, for example
+p50/p99 = 1.000/2.000 ms.
+*/
+func formatPercentiles(values map[string]time.Duration) string {
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return percentileOfName(names[i]) < percentileOfName(names[j]) })
+
+	durations := []string{}
+	for _, name := range names {
+		durations = append(durations, fmt.Sprintf("%0.3f", float64(values[name])/float64(time.Millisecond)))
+	}
+
+	return fmt.Sprintf("%s = %s ms", strings.Join(names, "/"), strings.Join(durations, "/"))
+}
+
+/*
+Format the percentiles in milliseconds.
+*/
+func (d *Distribution) String() string {
+	return formatPercentiles(d.Percentiles)
+}
+
+/*
+Create an empty histogram of the given bucket bounds.
+*/
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{
+		Bounds: append([]time.Duration{}, bounds...),
+		Counts: make([]int, len(bounds)+1),
+	}
+}
+
+/*
+Count a delay in its bucket.
+*/
+func (h *Histogram) add(delay time.Duration) {
+	h.Counts[sort.Search(len(h.Bounds), func(i int) bool { return h.Bounds[i] >= delay })]++
+}
+
+/*
+Format the non-empty buckets of the histogram, for example <=1ms:10 >1s:2.
+*/
+func (h Histogram) String() string {
+	buckets := []string{}
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
+		}
+		if i < len(h.Bounds) {
+			buckets = append(buckets, fmt.Sprintf("<=%s:%d", h.Bounds[i], count))
+		} else if len(h.Bounds) == 0 {
+			buckets = append(buckets, fmt.Sprintf("all:%d", count))
+		} else {
+			buckets = append(buckets, fmt.Sprintf(">%s:%d", h.Bounds[len(h.Bounds)-1], count))
+		}
+	}
+	return strings.Join(buckets, " ")
+}
+
+/*
+Get the percentiles and histograms of the RTT and of the one-way delays.
+*/
+func (r *PingResults) UpdateDistributions() {
+	percentiles := r.Stat.getPercentiles()
+	r.RTTDistribution = r.Stat.rttDelays.distribution(percentiles)
+	r.ForwardDistribution = r.Stat.forwardDelays.distribution(percentiles)
+	r.ReverseDistribution = r.Stat.reverseDelays.distribution(percentiles)
+}
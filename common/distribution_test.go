@@ -0,0 +1,77 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+Results of RTTs from 1 to 1000 ms, with equal one-way delays.
+*/
+func newRTTResults() []*TwampResult {
+	start := time.Unix(1700000000, 0)
+	results := []*TwampResult{}
+	for i := 1; i <= 1000; i++ {
+		rtt := time.Duration(i) * time.Millisecond
+		results = append(results, newTestResult(uint32(i), start.Add(rtt), rtt/2, 0, rtt/2))
+	}
+	return results
+}
+
+func TestDistribution(t *testing.T) {
+	pr := countResults(newRTTResults())
+
+	stats := pr.Stat
+	if stats.Received != 1000 || stats.Min != time.Millisecond || stats.Max != time.Second || stats.Avg != 500500*time.Microsecond {
+		t.Errorf("RTT min/avg/max %s/%s/%s, expected 1ms/500.5ms/1s", stats.Min, stats.Avg, stats.Max)
+	}
+	if !near(stats.StdDev, 288819*time.Microsecond, time.Millisecond) {
+		t.Errorf("RTT stddev %s, expected 288.819ms", stats.StdDev)
+	}
+
+	expected := map[string]time.Duration{
+		"p50":   500 * time.Millisecond,
+		"p90":   900 * time.Millisecond,
+		"p95":   950 * time.Millisecond,
+		"p99":   990 * time.Millisecond,
+		"p99.9": 999 * time.Millisecond,
+	}
+	for name, delay := range expected {
+		if p, ok := pr.RTTDistribution.Percentiles[name]; !ok || !near(p, delay, delay/1000+1) {
+			t.Errorf("RTT %s %s, expected %s", name, p, delay)
+		}
+		if p := pr.ForwardDistribution.Percentiles[name]; !near(p, delay/2, delay/2000+1) {
+			t.Errorf("forward delay %s %s, expected %s", name, p, delay/2)
+		}
+	}
+
+	// delays of 1, 2, 3-5, 6-10, ... 501-1000 ms in the default buckets
+	counts := []int{0, 0, 0, 1, 1, 3, 5, 10, 30, 50, 100, 300, 500, 0}
+	if histogram := pr.RTTDistribution.Histogram; !reflect.DeepEqual(histogram.Counts, counts) {
+		t.Errorf("RTT histogram %v, expected %v", histogram.Counts, counts)
+	}
+}
+
+func TestDistributionWithoutResults(t *testing.T) {
+	pr := countResults(nil)
+	if pr.RTTDistribution != nil || pr.ForwardDistribution != nil || pr.ReverseDistribution != nil {
+		t.Errorf("distributions %v %v %v without results", pr.RTTDistribution, pr.ForwardDistribution, pr.ReverseDistribution)
+	}
+}
+
+func TestConfiguredDistribution(t *testing.T) {
+	pr := &PingResults{Stat: NewPingResultStats([]float64{25, 75}, []time.Duration{250 * time.Millisecond, 750 * time.Millisecond})}
+	for _, r := range newRTTResults() {
+		pr.Stat.Count(r)
+	}
+	pr.UpdateStats()
+
+	d := pr.RTTDistribution
+	if len(d.Percentiles) != 2 || !near(d.Percentiles["p25"], 250*time.Millisecond, 251*time.Microsecond) || !near(d.Percentiles["p75"], 750*time.Millisecond, 751*time.Microsecond) {
+		t.Errorf("RTT percentiles %v, expected p25/p75 = 250/750 ms", d.Percentiles)
+	}
+	if counts := []int{250, 500, 250}; !reflect.DeepEqual(d.Histogram.Counts, counts) {
+		t.Errorf("RTT histogram %v, expected %v", d.Histogram.Counts, counts)
+	}
+}
@@ -0,0 +1,502 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Size of the buffer receiving the reflected packets.
+*/
+const maxPacketSize = 65536
+
+/*
+Without test packets in flight the receiver checks this often whether the sender
+has finished.
+*/
+const receiverPollInterval = 100 * time.Millisecond
+
+/*
+Lost test packets are remembered for this many loss thresholds to recognize their
+late reflected packets.
+*/
+const lateWindow = 10
+
+/*
+Protocol specific part of a test run by the Engine: building the test packets and
+decoding the reflected ones. TWAMP, TWAMP Light and STAMP tests implement it.
+*/
+type TestProtocol interface {
+	// Build the test packet of the given Sequence Number
+	NewTestPacket(sequence uint32) ([]byte, error)
+	// Decode a reflected packet, its SenderSeqNum identifies the test packet
+	DecodeReflectedPacket(pdu []byte, info PacketInfo) (*TwampResult, error)
+	// Check a reflected packet against the test packet it reflects
+	CheckReflectedPacket(r *TwampResult, pdu []byte, sent []byte) error
+}
+
+/*
+Test packet waiting for its reflected packet, or already received while its
+duplicates are recognized.
+*/
+type pendingPacket struct {
+	packet   []byte
+	deadline time.Time
+}
+
+/*
+Test engine sending test packets and matching the reflected packets to them by
+their Sender Sequence Number. Run sends on schedule from a sender goroutine while
+a receiver goroutine collects the reflected packets, so the sending rate is not
+limited by the round-trip time. Without interval a test packet is only sent when
+the previous one is received or lost.
+*/
+type Engine struct {
+	connection *net.UDPConn
+	protocol   TestProtocol
+	interval   time.Duration
+	timeout    time.Duration
+	// Sequence Number of the next test packet
+	Sequence uint32
+	// Results kept by Run: KeepAllResults, KeepNoResults or the size of a
+	// rolling window of the last results
+	KeepResults int
+	// Prefix of the logged errors, to tell the test sessions apart
+	LogPrefix string
+	// Percentiles and histogram bucket bounds of the statistics, the defaults
+	// when nil
+	Percentiles     []float64
+	HistogramBounds []time.Duration
+
+	late       int
+	duplicates int
+	reordering *reorderingTracker
+	// reordering of the late reflected packets received by RunOne
+	lateReordering PingResultStats
+
+	mutex       sync.Mutex
+	transmitted int
+	pending     map[uint32]*pendingPacket
+	order       []uint32                  // Sequence Numbers of the pending packets in sending order
+	lost        map[uint32]time.Time      // lost test packets, to recognize late reflected packets
+	received    map[uint32]*pendingPacket // received test packets, to recognize duplicates
+	idle        chan bool                 // signaled when the last test packet in flight is received or lost
+}
+
+/*
+Create a test engine sending test packets on the connection at the given
+interval. Test packets are lost when their reflected packet does not arrive
+within the timeout.
+*/
+func NewEngine(connection *net.UDPConn, protocol TestProtocol, interval time.Duration, timeout time.Duration) *Engine {
+	return &Engine{
+		connection: connection,
+		protocol:   protocol,
+		interval:   interval,
+		timeout:    timeout,
+		pending:    map[uint32]*pendingPacket{},
+		lost:       map[uint32]time.Time{},
+		received:   map[uint32]*pendingPacket{},
+	}
+}
+
+/*
+Get the number of reflected packets received after the loss threshold of their
+test packet. Their test packets are counted as lost.
+*/
+func (e *Engine) GetLate() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.late
+}
+
+/*
+Get the number of duplicated reflected packets.
+*/
+func (e *Engine) GetDuplicates() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.duplicates
+}
+
+/*
+Count the reordering of the late reflected packets received by RunOne in the
+statistics. Their test packets are counted as lost, not as received.
+*/
+func (e *Engine) CountLateReordering(stats *PingResultStats) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats.addReordering(&e.lateReordering)
+}
+
+/*
+Send one test packet and wait for its reflected packet until the session timeout.
+Reflected packets of earlier test packets are counted as late and classified, or
+as duplicates when already received, other packets are logged and ignored.
+*/
+func (e *Engine) RunOne() (*TwampResult, error) {
+	sequence := e.Sequence
+	e.Sequence++
+
+	if e.reordering == nil {
+		e.reordering = newReorderingTracker(sequence)
+	}
+	e.expire(time.Now())
+
+	deadline := time.Now().Add(e.timeout)
+	packet, err := e.protocol.NewTestPacket(sequence)
+	if err != nil {
+		return nil, err
+	}
+	_, err = e.connection.Write(packet)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, info, _, err := ReadWithDeadline(e.connection, buf, deadline, sequence, e.timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		// stray packets do not end the wait for the reflected packet
+		r, err := e.protocol.DecodeReflectedPacket(buf[:n], info)
+		if err != nil {
+			e.logError(err)
+			continue
+		}
+
+		// reflected packet of a test packet already received or considered lost
+		if IsLate(r.SenderSeqNum, sequence) {
+			e.mutex.Lock()
+			if _, ok := e.received[r.SenderSeqNum]; ok {
+				e.duplicates++
+			} else {
+				// further copies are duplicates
+				e.late++
+				e.received[r.SenderSeqNum] = &pendingPacket{deadline: deadline}
+				e.reordering.classify(r)
+				e.lateReordering.CountReordering(r)
+			}
+			e.mutex.Unlock()
+			continue
+		}
+
+		if r.SenderSeqNum != sequence {
+			e.logError(fmt.Errorf("Expected Sequence # %d but received %d.", sequence, r.SenderSeqNum))
+			continue
+		}
+
+		err = e.protocol.CheckReflectedPacket(r, buf[:n], packet)
+		if err != nil {
+			e.logError(err)
+			continue
+		}
+
+		r.SenderSize = len(packet)
+		e.reordering.classify(r)
+
+		e.mutex.Lock()
+		e.received[sequence] = &pendingPacket{packet: packet, deadline: deadline}
+		e.mutex.Unlock()
+
+		return r, nil
+	}
+}
+
+/*
+Send count test packets at the engine interval and collect the reflected ones
+until the last test packet is received or lost. The callback is called for every
+test packet, with a nil result for lost ones, and for every duplicated reflected
+packet. The doneSignal stops sending, the test packets in flight are still waited
+for.
+*/
+func (e *Engine) Run(count int, callback TwampTestCallbackFunction, doneSignal chan bool) *PingResults {
+	Stats := NewPingResultStats(e.Percentiles, e.HistogramBounds)
+	Results := &PingResults{Stat: Stats}
+
+	e.mutex.Lock()
+	e.transmitted = 0
+	e.reordering = newReorderingTracker(e.Sequence)
+	e.idle = make(chan bool, 1)
+	e.mutex.Unlock()
+
+	sent := make(chan bool)
+	stop := make(chan bool)
+	go e.send(count, doneSignal, stop, sent)
+
+	sending := true
+	buf := make([]byte, maxPacketSize)
+	for {
+		// the receiver wakes up at the loss threshold of the oldest test packet
+		e.mutex.Lock()
+		deadline := time.Now().Add(receiverPollInterval)
+		if len(e.order) > 0 {
+			deadline = e.pending[e.order[0]].deadline
+		}
+		e.mutex.Unlock()
+
+		if sending {
+			select {
+			case <-sent:
+				sending = false
+			default:
+			}
+		}
+
+		err := e.connection.SetReadDeadline(deadline)
+		if err != nil {
+			e.logError(err)
+			break
+		}
+
+		n, info, _, err := ReadWithInfo(e.connection, buf)
+		if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			e.logError(err)
+			break
+		}
+
+		if err == nil {
+			r, err := e.receive(buf[:n], info)
+			if err != nil {
+				e.logError(err)
+			} else if r != nil {
+				Stats.Count(r)
+				Results.AddResult(r, e.KeepResults)
+
+				e.updateStats(false, Stats, Results)
+				if callback != nil {
+					callback(count, r, Stats)
+				}
+			}
+		}
+
+		for _, sequence := range e.expire(time.Now()) {
+			e.logError(&LostPacketError{Sequence: sequence, Timeout: e.timeout})
+
+			e.updateStats(false, Stats, Results)
+			if callback != nil {
+				callback(count, nil, Stats)
+			}
+		}
+
+		e.mutex.Lock()
+		done := !sending && len(e.order) == 0
+		e.mutex.Unlock()
+		if done {
+			break
+		}
+	}
+
+	// the sender may still be running after a read error
+	close(stop)
+	<-sent
+
+	e.updateStats(true, Stats, Results)
+
+	return Results
+}
+
+/*
+Send the test packets on schedule. The schedule does not drift with the time
+taken by sending. Without interval every test packet waits for the previous one
+to be received or lost.
+*/
+func (e *Engine) send(count int, doneSignal chan bool, stop chan bool, sent chan bool) {
+	defer close(sent)
+
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if !e.waitToSend(i, start, doneSignal, stop) {
+			return
+		}
+
+		e.mutex.Lock()
+		sequence := e.Sequence
+		e.Sequence++
+		e.mutex.Unlock()
+
+		// a test packet which cannot be built stops sending
+		packet, err := e.protocol.NewTestPacket(sequence)
+		if err != nil {
+			e.logError(err)
+			return
+		}
+
+		e.mutex.Lock()
+		e.pending[sequence] = &pendingPacket{packet: packet, deadline: time.Now().Add(e.timeout)}
+		e.order = append(e.order, sequence)
+		e.transmitted++
+		e.mutex.Unlock()
+
+		_, err = e.connection.Write(packet)
+		if err != nil {
+			// the test packet is lost at its loss threshold
+			e.logError(err)
+		}
+	}
+}
+
+/*
+Wait until the test packet i is due: at its time in the schedule, or without
+interval when no test packet is in flight. It returns false when sending stops.
+*/
+func (e *Engine) waitToSend(i int, start time.Time, doneSignal chan bool, stop chan bool) bool {
+	var due <-chan time.Time
+	var idle chan bool
+	if e.interval > 0 || i == 0 {
+		wait := time.NewTimer(time.Until(start.Add(time.Duration(i) * e.interval)))
+		defer wait.Stop()
+		due = wait.C
+	} else {
+		idle = e.idle
+	}
+
+	select {
+	case <-doneSignal:
+		return false
+	case <-stop:
+		return false
+	case <-due:
+	case <-idle:
+	}
+	return true
+}
+
+/*
+Signal the sender that no test packet is in flight. The mutex must be held.
+*/
+func (e *Engine) signalIdle() {
+	if len(e.order) > 0 || e.idle == nil {
+		return
+	}
+
+	select {
+	case e.idle <- true:
+	default:
+	}
+}
+
+func (e *Engine) logError(err error) {
+	log.Printf("%s%v\n", e.LogPrefix, err)
+}
+
+/*
+Match a reflected packet to its test packet and classify its reordering. Further
+copies of received reflected packets are returned as duplicates, reflected
+packets of lost test packets are counted as late and unknown ones are ignored.
+*/
+func (e *Engine) receive(pdu []byte, info PacketInfo) (*TwampResult, error) {
+	r, err := e.protocol.DecodeReflectedPacket(pdu, info)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mutex.Lock()
+	pending, ok := e.pending[r.SenderSeqNum]
+	if ok {
+		delete(e.pending, r.SenderSeqNum)
+		e.removeOrder(r.SenderSeqNum)
+		e.received[r.SenderSeqNum] = pending
+		e.signalIdle()
+	} else if received, duplicate := e.received[r.SenderSeqNum]; duplicate {
+		pending = received
+		r.Duplicate = true
+		e.duplicates++
+	} else if _, lost := e.lost[r.SenderSeqNum]; lost {
+		delete(e.lost, r.SenderSeqNum)
+		e.late++
+	}
+	e.mutex.Unlock()
+
+	if pending == nil {
+		return nil, nil
+	}
+
+	err = e.protocol.CheckReflectedPacket(r, pdu, pending.packet)
+	if err != nil {
+		return nil, err
+	}
+
+	r.SenderSize = len(pending.packet)
+	if !r.Duplicate {
+		e.reordering.classify(r)
+	}
+	return r, nil
+}
+
+/*
+Remove a test packet from the sending order.
+*/
+func (e *Engine) removeOrder(sequence uint32) {
+	for i, s := range e.order {
+		if s == sequence {
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+Expire the test packets past their loss threshold and return their Sequence
+Numbers. Lost and received test packets are remembered for a while to recognize
+late and duplicated reflected packets.
+*/
+func (e *Engine) expire(now time.Time) []uint32 {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for sequence, expired := range e.lost {
+		if now.Sub(expired) > lateWindow*e.timeout {
+			delete(e.lost, sequence)
+		}
+	}
+	for sequence, received := range e.received {
+		if now.Sub(received.deadline) > lateWindow*e.timeout {
+			delete(e.received, sequence)
+		}
+	}
+
+	expired := []uint32{}
+	for len(e.order) > 0 {
+		sequence := e.order[0]
+		if e.pending[sequence].deadline.After(now) {
+			break
+		}
+
+		delete(e.pending, sequence)
+		e.order = e.order[1:]
+		e.lost[sequence] = now
+		expired = append(expired, sequence)
+	}
+	if len(expired) > 0 {
+		e.signalIdle()
+	}
+
+	return expired
+}
+
+func (e *Engine) updateStats(final bool, stats *PingResultStats, Results *PingResults) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats.Transmitted = e.transmitted
+	if stats.Transmitted > 0 {
+		// test packets in flight are not lost yet
+		stats.Loss = float64(stats.Transmitted-stats.Received-len(e.order)) / float64(stats.Transmitted) * 100.0
+	}
+	stats.Late = e.late
+	stats.SetDuplicates(e.duplicates)
+	if final {
+		Results.UpdateStats()
+	}
+}
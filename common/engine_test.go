@@ -0,0 +1,217 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+/*
+Test protocol whose packets are their Sender Sequence Number.
+*/
+type sequenceProtocol struct{}
+
+func (sequenceProtocol) NewTestPacket(sequence uint32) ([]byte, error) {
+	return sequencePacket(sequence), nil
+}
+
+func (sequenceProtocol) DecodeReflectedPacket(pdu []byte, info PacketInfo) (*TwampResult, error) {
+	if len(pdu) != 4 {
+		return nil, errors.New("Not a test packet.")
+	}
+	now := time.Now()
+	return &TwampResult{
+		SenderSeqNum:      binary.BigEndian.Uint32(pdu),
+		SenderTimestamp:   now,
+		ReceiveTimestamp:  now,
+		Timestamp:         now,
+		FinishedTimestamp: now,
+	}, nil
+}
+
+func (sequenceProtocol) CheckReflectedPacket(r *TwampResult, pdu []byte, sent []byte) error {
+	return nil
+}
+
+/*
+Packet of sequenceProtocol with the given Sender Sequence Number.
+*/
+func sequencePacket(sequence uint32) []byte {
+	packet := make([]byte, 4)
+	binary.BigEndian.PutUint32(packet, sequence)
+	return packet
+}
+
+/*
+Start a reflector of sequenceProtocol packets on the loopback interface and
+connect to it. The handler is called with the Sender Sequence Number of every
+received test packet and sends the reflected packets with reply.
+*/
+func newTestReflector(t *testing.T, handler func(sequence uint32, reply func(sequence uint32))) *net.UDPConn {
+	return newRawTestReflector(t, func(sequence uint32, send func(packet []byte)) {
+		handler(sequence, func(sequence uint32) { send(sequencePacket(sequence)) })
+	})
+}
+
+/*
+Start a reflector like newTestReflector, whose handler sends any packet.
+*/
+func newRawTestReflector(t *testing.T, handler func(sequence uint32, send func(packet []byte))) *net.UDPConn {
+	reflector, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, reflector.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		reflector.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		reflector.Close()
+	})
+
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := reflector.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n != 4 {
+				continue
+			}
+
+			handler(binary.BigEndian.Uint32(buf), func(packet []byte) {
+				reflector.WriteToUDP(packet, addr)
+			})
+		}
+	}()
+
+	return conn
+}
+
+func TestRun(t *testing.T) {
+	// 5 is lost, 3 is reflected twice and 7 is reflected after its loss
+	// threshold, when 12 arrives
+	conn := newTestReflector(t, func(sequence uint32, reply func(uint32)) {
+		switch sequence {
+		case 5, 7:
+		case 3:
+			reply(sequence)
+			reply(sequence)
+		case 12:
+			reply(7)
+			reply(sequence)
+		default:
+			reply(sequence)
+		}
+	})
+
+	callbacks := 0
+	e := NewEngine(conn, sequenceProtocol{}, 20*time.Millisecond, 50*time.Millisecond)
+	results := e.Run(20, func(count int, r *TwampResult, stats *PingResultStats) { callbacks++ }, nil)
+
+	stats := results.Stat
+	if stats.Transmitted != 20 || stats.Received != 18 || stats.Late != 1 || stats.Duplicates != 1 {
+		t.Errorf("%d transmitted, %d received, %d late, %d duplicates, expected 20, 18, 1, 1",
+			stats.Transmitted, stats.Received, stats.Late, stats.Duplicates)
+	}
+	if stats.Loss < 9.9 || stats.Loss > 10.1 {
+		t.Errorf("loss %0.1f%%, expected 10%%", stats.Loss)
+	}
+	// every test packet, received or lost, and the duplicate
+	if callbacks != 21 {
+		t.Errorf("%d callbacks, expected 21", callbacks)
+	}
+	if e.Sequence != 20 {
+		t.Errorf("next Sequence Number %d, expected 20", e.Sequence)
+	}
+}
+
+func TestRunIsPipelined(t *testing.T) {
+	// every reflected packet takes 5 intervals
+	conn := newTestReflector(t, func(sequence uint32, reply func(uint32)) {
+		time.AfterFunc(50*time.Millisecond, func() { reply(sequence) })
+	})
+
+	start := time.Now()
+	e := NewEngine(conn, sequenceProtocol{}, 10*time.Millisecond, time.Second)
+	results := e.Run(20, nil, nil)
+
+	if results.Stat.Received != 20 {
+		t.Errorf("%d received, expected 20", results.Stat.Received)
+	}
+	// one test packet at a time would take at least a second
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		t.Errorf("test run took %s, expected about 250ms", elapsed)
+	}
+}
+
+func TestRunStops(t *testing.T) {
+	conn := newTestReflector(t, func(sequence uint32, reply func(uint32)) { reply(sequence) })
+
+	done := make(chan bool)
+	time.AfterFunc(55*time.Millisecond, func() { close(done) })
+
+	e := NewEngine(conn, sequenceProtocol{}, 10*time.Millisecond, time.Second)
+	results := e.Run(1000, nil, done)
+
+	stats := results.Stat
+	if stats.Transmitted < 3 || stats.Transmitted > 10 || stats.Received != stats.Transmitted {
+		t.Errorf("%d transmitted, %d received after stopping, expected about 6", stats.Transmitted, stats.Received)
+	}
+}
+
+func TestRunOneIgnoresStrayPackets(t *testing.T) {
+	// a packet of another protocol and a reflected packet of a future test
+	// packet arrive before the reflected packet
+	conn := newRawTestReflector(t, func(sequence uint32, send func([]byte)) {
+		send([]byte("stray"))
+		send(sequencePacket(sequence + 5))
+		send(sequencePacket(sequence))
+	})
+
+	e := NewEngine(conn, sequenceProtocol{}, 10*time.Millisecond, time.Second)
+	for sequence := uint32(0); sequence < 3; sequence++ {
+		r, err := e.RunOne()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.SenderSeqNum != sequence {
+			t.Errorf("reflected packet %d, expected %d", r.SenderSeqNum, sequence)
+		}
+	}
+}
+
+/*
+sequenceProtocol whose test packets cannot be built from a Sequence Number on.
+*/
+type failingProtocol struct {
+	sequenceProtocol
+	from uint32
+}
+
+func (p failingProtocol) NewTestPacket(sequence uint32) ([]byte, error) {
+	if sequence >= p.from {
+		return nil, errors.New("Cannot build the test packet.")
+	}
+	return p.sequenceProtocol.NewTestPacket(sequence)
+}
+
+func TestRunStopsOnPacketError(t *testing.T) {
+	conn := newTestReflector(t, func(sequence uint32, reply func(uint32)) { reply(sequence) })
+
+	e := NewEngine(conn, failingProtocol{from: 3}, 10*time.Millisecond, time.Second)
+	results := e.Run(10, nil, nil)
+	if results.Stat.Transmitted != 3 || results.Stat.Received != 3 {
+		t.Errorf("%d transmitted, %d received, expected 3 and 3", results.Stat.Transmitted, results.Stat.Received)
+	}
+
+	if _, err := e.RunOne(); err == nil {
+		t.Error("test packet sent, expected an error")
+	}
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+Error Estimate of a timestamp (RFC 4656 section 4.1.2): the S flag tells whether
+the clock is synchronized to an external source, the Z flag the format of the
+timestamp (RFC 8186) and the error is Multiplier*2^(Scale-32) seconds.
+*/
+type ErrorEstimate struct {
+	Synchronized bool  `json:"synchronized"`
+	PTP          bool  `json:"ptp"`
+	Scale        uint8 `json:"scale"`
+	Multiplier   uint8 `json:"multiplier"`
+}
+
+const (
+	errorEstimateS     = 0x8000
+	errorEstimateScale = 0x3f00
+)
+
+/*
+Error Estimate sent when the quality of the local clock is not known.
+*/
+const defaultErrorEstimate = 0x0101
+
+/*
+The clock status is queried from the clock source this often.
+*/
+const clockStatusInterval = time.Second
+
+/*
+Decode the 16-bit Error Estimate of a test packet.
+*/
+func NewErrorEstimate(errorEstimate uint16) ErrorEstimate {
+	return ErrorEstimate{
+		Synchronized: errorEstimate&errorEstimateS != 0,
+		PTP:          errorEstimate&ErrorEstimateZ != 0,
+		Scale:        uint8((errorEstimate & errorEstimateScale) >> 8),
+		Multiplier:   uint8(errorEstimate),
+	}
+}
+
+/*
+Compute the Error Estimate of a timestamp of the given format taken by a clock
+of the given status. The error is rounded up to the next representable value.
+*/
+func NewErrorEstimateFromStatus(status *ClockStatus, format TimestampFormat) ErrorEstimate {
+	e := ErrorEstimate{
+		Synchronized: status.Synchronized,
+		PTP:          format == TimestampPTP,
+		Scale:        63,
+		Multiplier:   255,
+	}
+
+	units := status.MaxError.Seconds() * (1 << 32)
+	for scale := 0; scale < 64; scale++ {
+		multiplier := math.Ceil(units / math.Ldexp(1, scale))
+		if multiplier <= 255 {
+			// the Multiplier must not be zero
+			e.Scale = uint8(scale)
+			e.Multiplier = uint8(math.Max(multiplier, 1))
+			break
+		}
+	}
+
+	return e
+}
+
+/*
+Encode the Error Estimate into its 16-bit wire format.
+*/
+func (e ErrorEstimate) Encode() uint16 {
+	errorEstimate := uint16(e.Scale&0x3f)<<8 | uint16(e.Multiplier)
+	if e.Synchronized {
+		errorEstimate |= errorEstimateS
+	}
+	if e.PTP {
+		errorEstimate |= ErrorEstimateZ
+	}
+	return errorEstimate
+}
+
+/*
+Get the estimated error of the timestamp.
+*/
+func (e ErrorEstimate) GetError() time.Duration {
+	return time.Duration(math.Ldexp(float64(e.Multiplier), int(e.Scale)-32) * float64(time.Second))
+}
+
+func (e ErrorEstimate) String() string {
+	return fmt.Sprintf("synchronized=%t error=%s", e.Synchronized, e.GetError())
+}
+
+/*
+Synchronization status of the local clock.
+*/
+type ClockStatus struct {
+	// Whether the clock is synchronized to an external source (UTC)
+	Synchronized bool
+	// Maximum error of the clock
+	MaxError time.Duration
+}
+
+/*
+Source of the synchronization status of the local clock, used for the Error
+Estimate of the sent timestamps.
+*/
+type ClockSource interface {
+	GetClockStatus() (*ClockStatus, error)
+}
+
+/*
+Clock source of a configured, fixed status.
+*/
+type StaticClock ClockStatus
+
+func (c StaticClock) GetClockStatus() (*ClockStatus, error) {
+	status := ClockStatus(c)
+	return &status, nil
+}
+
+var clock = struct {
+	mutex  sync.Mutex
+	source ClockSource
+	status *ClockStatus
+	stop   chan bool
+}{}
+
+/*
+Set the source of the clock status used for the Error Estimate of all sent
+timestamps. Without a source the clock is reported as unsynchronized. The status
+is refreshed in the background every clockStatusInterval, so taking a timestamp
+never waits for the clock source.
+*/
+func SetClockSource(source ClockSource) {
+	var status *ClockStatus
+	if source != nil {
+		status = queryClockStatus(source)
+	}
+
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.stop != nil {
+		close(clock.stop)
+		clock.stop = nil
+	}
+
+	clock.source = source
+	clock.status = status
+	if source != nil {
+		clock.stop = make(chan bool)
+		go refreshClockStatus(source, clock.stop)
+	}
+}
+
+func queryClockStatus(source ClockSource) *ClockStatus {
+	status, err := source.GetClockStatus()
+	if err != nil {
+		log.Printf("Cannot get the clock status: %v\n", err)
+	}
+	return status
+}
+
+/*
+Query the clock status every clockStatusInterval until the clock source is
+replaced.
+*/
+func refreshClockStatus(source ClockSource, stop chan bool) {
+	ticker := time.NewTicker(clockStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		status := queryClockStatus(source)
+
+		clock.mutex.Lock()
+		select {
+		case <-stop:
+			// the status of a replaced source is not used
+		default:
+			clock.status = status
+		}
+		clock.mutex.Unlock()
+	}
+}
+
+/*
+Get the Error Estimate of a timestamp of the given format taken now, from the
+last clock status of the clock source.
+*/
+func GetErrorEstimate(format TimestampFormat) uint16 {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	if clock.source == nil || clock.status == nil {
+		return SetTimestampFormat(defaultErrorEstimate, format)
+	}
+
+	return NewErrorEstimateFromStatus(clock.status, format).Encode()
+}
+
+/*
+Get a clock source by name: "none", "kernel" or "ntpd" (queried on its local
+control port).
+*/
+func NewClockSource(name string) (ClockSource, error) {
+	switch name {
+	case "", "none":
+		return nil, nil
+	case "kernel":
+		return KernelClock{}, nil
+	case "ntpd":
+		return NewNtpControlClock(DefaultNtpControlAddress), nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown clock source %q.", name))
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Address of the NTP control port of the local ntpd.
+*/
+const DefaultNtpControlAddress = "127.0.0.1:123"
+
+const (
+	ntpControlHeaderSize = 12
+	ntpControlTimeout    = time.Second
+	// NTP version 4, mode 6 (control message)
+	ntpControlVersionMode = 4<<3 | 6
+	ntpControlReadVars    = 2
+	ntpControlResponse    = 0x80
+	ntpControlError       = 0x40
+	ntpControlMore        = 0x20
+	// Leap Indicator of an unsynchronized clock
+	ntpLeapAlarm      = 3
+	ntpStratumUnsynch = 16
+)
+
+/*
+Clock source querying the system variables of ntpd with an NTP control message
+(mode 6, as ntpq does). The maximum error is the root distance: half the root
+delay plus the root dispersion.
+*/
+type NtpControlClock struct {
+	Address  string
+	sequence uint16
+}
+
+func NewNtpControlClock(address string) *NtpControlClock {
+	return &NtpControlClock{Address: address}
+}
+
+func (c *NtpControlClock) GetClockStatus() (*ClockStatus, error) {
+	conn, err := net.Dial("udp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(ntpControlTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	c.sequence++
+	variables := "leap,stratum,rootdelay,rootdisp"
+	request := make([]byte, ntpControlHeaderSize+(len(variables)+3)/4*4)
+	request[0] = ntpControlVersionMode
+	request[1] = ntpControlReadVars
+	binary.BigEndian.PutUint16(request[2:], c.sequence)
+	binary.BigEndian.PutUint16(request[10:], uint16(len(variables)))
+	copy(request[ntpControlHeaderSize:], variables)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// the response may be split into several fragments
+	data := []byte{}
+	status := uint16(0)
+	buf := make([]byte, 65536)
+	for more := true; more; {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n < ntpControlHeaderSize {
+			return nil, errors.New(fmt.Sprintf("NTP control response too short: %d bytes.", n))
+		}
+		if buf[1]&ntpControlResponse == 0 || buf[1]&0x1f != ntpControlReadVars || binary.BigEndian.Uint16(buf[2:]) != c.sequence {
+			continue
+		}
+		if buf[1]&ntpControlError != 0 {
+			return nil, errors.New(fmt.Sprintf("NTP control error status %d.", binary.BigEndian.Uint16(buf[4:])>>8))
+		}
+
+		status = binary.BigEndian.Uint16(buf[4:])
+		offset := int(binary.BigEndian.Uint16(buf[8:]))
+		count := int(binary.BigEndian.Uint16(buf[10:]))
+		if ntpControlHeaderSize+count > n {
+			return nil, errors.New(fmt.Sprintf("NTP control response truncated: %d bytes of %d.", n-ntpControlHeaderSize, count))
+		}
+		if offset+count > len(data) {
+			data = append(data, make([]byte, offset+count-len(data))...)
+		}
+		copy(data[offset:], buf[ntpControlHeaderSize:ntpControlHeaderSize+count])
+		more = buf[1]&ntpControlMore != 0
+	}
+
+	values := parseNtpVariables(string(data))
+
+	stratum, err := strconv.Atoi(values["stratum"])
+	if err != nil {
+		stratum = ntpStratumUnsynch
+	}
+
+	// milliseconds, older ntpd versions call the root dispersion rootdispersion
+	rootDelay, err := strconv.ParseFloat(values["rootdelay"], 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("NTP control response without root delay: %q", data))
+	}
+	rootDisp, ok := values["rootdisp"]
+	if !ok {
+		rootDisp = values["rootdispersion"]
+	}
+	rootDispersion, err := strconv.ParseFloat(rootDisp, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("NTP control response without root dispersion: %q", data))
+	}
+
+	return &ClockStatus{
+		Synchronized: status>>14 != ntpLeapAlarm && stratum < ntpStratumUnsynch,
+		MaxError:     time.Duration((rootDelay/2 + rootDispersion) * float64(time.Millisecond)),
+	}, nil
+}
+
+/*
+Parse the name=value list of an NTP control read variables response.
+*/
+func parseNtpVariables(data string) map[string]string {
+	values := map[string]string{}
+	for _, variable := range strings.Split(data, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(variable), "=")
+		values[name] = strings.Trim(value, "\"")
+	}
+	return values
+}
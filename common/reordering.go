@@ -0,0 +1,124 @@
+package common
+
+/*
+Number of recent arrivals kept to compute the reordering extent. Larger extents
+are reported as this value.
+*/
+const reorderingHistory = 1024
+
+/*
+Largest n of the n-reordering metric reported in the statistics.
+*/
+const MaxNReordering = 5
+
+/*
+Reordering classification of the reflected packets in arrival order, as defined
+by RFC 4737. A packet whose Sender Sequence Number is lower than the next
+expected one is reordered.
+*/
+type reorderingTracker struct {
+	nextExpected uint32
+	arrivals     []uint32 // Sender Sequence Numbers of the recent arrivals, oldest first
+}
+
+func newReorderingTracker(first uint32) *reorderingTracker {
+	return &reorderingTracker{nextExpected: first}
+}
+
+/*
+Classify a reflected packet (not a duplicate) and record its arrival.
+*/
+func (t *reorderingTracker) classify(r *TwampResult) {
+	sequence := r.SenderSeqNum
+
+	if int32(sequence-t.nextExpected) >= 0 {
+		t.nextExpected = sequence + 1
+	} else {
+		r.Reordered = true
+		r.ReorderingGap = int(t.nextExpected - sequence)
+
+		// extent: distance to the earliest arrival with a higher Sequence Number
+		r.ReorderingExtent = reorderingHistory
+		for i, arrival := range t.arrivals {
+			if int32(arrival-sequence) > 0 {
+				r.ReorderingExtent = len(t.arrivals) - i
+				break
+			}
+		}
+
+		// n-reordering: the last n arrivals all have higher Sequence Numbers
+		for i := len(t.arrivals) - 1; i >= 0 && int32(t.arrivals[i]-sequence) > 0; i-- {
+			r.ReorderingDegree++
+		}
+	}
+
+	t.arrivals = append(t.arrivals, sequence)
+	if len(t.arrivals) > reorderingHistory {
+		t.arrivals = t.arrivals[1:]
+	}
+}
+
+/*
+Count the reordering of a received test packet. The ratios are relative to the
+received packets.
+*/
+func (s *PingResultStats) CountReordering(r *TwampResult) {
+	if r.Reordered {
+		s.Reordered++
+		if s.MaxReorderingExtent < r.ReorderingExtent {
+			s.MaxReorderingExtent = r.ReorderingExtent
+		}
+
+		if len(s.nReordered) == 0 {
+			s.nReordered = make([]int, MaxNReordering)
+		}
+		for n := 1; n <= MaxNReordering && n <= r.ReorderingDegree; n++ {
+			s.nReordered[n-1]++
+		}
+	}
+
+	s.updateReordering()
+}
+
+/*
+Add the reordering counted in other statistics.
+*/
+func (s *PingResultStats) addReordering(other *PingResultStats) {
+	s.Reordered += other.Reordered
+	if s.MaxReorderingExtent < other.MaxReorderingExtent {
+		s.MaxReorderingExtent = other.MaxReorderingExtent
+	}
+
+	if len(other.nReordered) > 0 && len(s.nReordered) == 0 {
+		s.nReordered = make([]int, MaxNReordering)
+	}
+	for n := range other.nReordered {
+		s.nReordered[n] += other.nReordered[n]
+	}
+
+	s.updateReordering()
+}
+
+/*
+Set the number of duplicated reflected packets (RFC 5560). The ratio is relative
+to the transmitted packets.
+*/
+func (s *PingResultStats) SetDuplicates(duplicates int) {
+	s.Duplicates = duplicates
+	s.updateReordering()
+}
+
+func (s *PingResultStats) updateReordering() {
+	if s.Received > 0 {
+		s.ReorderedRatio = float64(s.Reordered) / float64(s.Received) * 100.0
+
+		s.NReordering = make([]float64, MaxNReordering)
+		for n := range s.nReordered {
+			s.NReordering[n] = float64(s.nReordered[n]) / float64(s.Received) * 100.0
+		}
+	}
+
+	if s.Transmitted > 0 {
+		s.DuplicateRatio = float64(s.Duplicates) / float64(s.Transmitted) * 100.0
+	}
+}
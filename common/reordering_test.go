@@ -0,0 +1,185 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Expected classification of a reflected packet.
+*/
+type reordering struct {
+	reordered bool
+	extent    int
+	gap       int
+	degree    int
+}
+
+func TestReorderingTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    uint32
+		arrivals []uint32
+		expected map[int]reordering // by arrival index, the other arrivals are in order
+	}{
+		{"in order", 1, []uint32{1, 2, 3, 4}, nil},
+		{"loss is not reordering", 1, []uint32{1, 3, 4, 6}, nil},
+		{"swapped", 1, []uint32{1, 3, 2, 4}, map[int]reordering{
+			2: {true, 1, 2, 1},
+		}},
+		// RFC 4737 section 4.2: the extent is the distance to the earliest
+		// arrival with a higher Sequence Number
+		{"late by four", 1, []uint32{1, 2, 3, 5, 6, 7, 8, 4, 9}, map[int]reordering{
+			7: {true, 4, 5, 4},
+		}},
+		{"reversed", 1, []uint32{1, 4, 3, 2}, map[int]reordering{
+			2: {true, 1, 2, 1},
+			3: {true, 2, 3, 2},
+		}},
+		// RFC 4737 section 5: 5 is 1-reordered, 6 follows 5 and is reordered but
+		// not 1-reordered
+		{"n-reordering", 1, []uint32{1, 2, 3, 4, 7, 5, 6, 8}, map[int]reordering{
+			5: {true, 1, 3, 1},
+			6: {true, 2, 2, 0},
+		}},
+		{"sequence wrap", 0xfffffffe, []uint32{0xfffffffe, 0xffffffff, 1, 0, 2}, map[int]reordering{
+			3: {true, 1, 2, 1},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := newReorderingTracker(test.first)
+			for i, sequence := range test.arrivals {
+				r := &TwampResult{SenderSeqNum: sequence}
+				tracker.classify(r)
+
+				got := reordering{r.Reordered, r.ReorderingExtent, r.ReorderingGap, r.ReorderingDegree}
+				if got != test.expected[i] {
+					t.Errorf("arrival %d of %d: %+v, expected %+v", i, sequence, got, test.expected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCountReordering(t *testing.T) {
+	tracker := newReorderingTracker(1)
+	stats := &PingResultStats{Transmitted: 8}
+	for _, sequence := range []uint32{1, 2, 4, 5, 3, 6, 8, 7} {
+		r := &TwampResult{SenderSeqNum: sequence}
+		tracker.classify(r)
+		stats.Received++
+		stats.CountReordering(r)
+	}
+
+	if stats.Reordered != 2 || stats.ReorderedRatio != 25 || stats.MaxReorderingExtent != 2 {
+		t.Errorf("%d reordered, %0.1f%%, max extent %d, expected 2, 25%%, 2",
+			stats.Reordered, stats.ReorderedRatio, stats.MaxReorderingExtent)
+	}
+
+	expected := []float64{25, 12.5, 0, 0, 0}
+	for n := range expected {
+		if stats.NReordering[n] != expected[n] {
+			t.Errorf("%d-reordering %0.1f%%, expected %0.1f%%", n+1, stats.NReordering[n], expected[n])
+		}
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	tests := []struct {
+		name       string
+		arrivals   []uint32
+		lost       bool // the test packets are lost before the arrivals
+		duplicates int
+		ratio      float64
+		reordered  int
+		late       int
+	}{
+		{"none", []uint32{0, 1, 2, 3}, false, 0, 0, 0, 0},
+		// RFC 5560 section 4: every further copy is a duplicate, the ratio is
+		// relative to the test packets sent
+		{"copies", []uint32{0, 1, 1, 2, 2, 2, 3}, false, 3, 75, 0, 0},
+		{"duplicates are not reordered", []uint32{0, 2, 1, 2, 3, 2}, false, 2, 50, 1, 0},
+		{"copies of lost packets are late", []uint32{0, 0, 1}, true, 0, 0, 0, 2},
+	}
+
+	protocol := sequenceProtocol{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := NewEngine(nil, protocol, time.Second, time.Second)
+			e.reordering = newReorderingTracker(0)
+			deadline := time.Now().Add(time.Minute)
+			for sequence := uint32(0); sequence < 4; sequence++ {
+				e.pending[sequence] = &pendingPacket{packet: sequencePacket(sequence), deadline: deadline}
+				e.order = append(e.order, sequence)
+			}
+			if test.lost {
+				e.expire(deadline)
+			}
+
+			stats := &PingResultStats{Transmitted: 4}
+			for _, sequence := range test.arrivals {
+				r, err := e.receive(sequencePacket(sequence), PacketInfo{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if r != nil && !r.Duplicate {
+					stats.Received++
+					stats.CountReordering(r)
+				}
+			}
+			stats.SetDuplicates(e.GetDuplicates())
+
+			if stats.Duplicates != test.duplicates || stats.DuplicateRatio != test.ratio || stats.Reordered != test.reordered {
+				t.Errorf("%d duplicates, %0.1f%%, %d reordered, expected %d, %0.1f%%, %d",
+					stats.Duplicates, stats.DuplicateRatio, stats.Reordered, test.duplicates, test.ratio, test.reordered)
+			}
+			if late := e.GetLate(); late != test.late {
+				t.Errorf("%d late, expected %d", late, test.late)
+			}
+		})
+	}
+}
+
+func TestRunOneLateReordering(t *testing.T) {
+	// 0 is reflected after 1 and again after 2
+	conn := newTestReflector(t, func(sequence uint32, reply func(uint32)) {
+		switch sequence {
+		case 0:
+		case 1:
+			reply(1)
+			reply(0)
+		case 2:
+			reply(2)
+			reply(0)
+		default:
+			reply(sequence)
+		}
+	})
+
+	e := NewEngine(conn, sequenceProtocol{}, 10*time.Millisecond, 50*time.Millisecond)
+	if _, err := e.RunOne(); !IsLost(err) {
+		t.Fatalf("test packet 0: %v, expected it lost", err)
+	}
+	for sequence := uint32(1); sequence < 4; sequence++ {
+		r, err := e.RunOne()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Reordered {
+			t.Errorf("test packet %d reordered", sequence)
+		}
+	}
+
+	// 0 arrives right after 1: extent 1 and 1-reordering, the copy is a duplicate
+	stats := &PingResultStats{Received: 3}
+	e.CountLateReordering(stats)
+	if stats.Reordered != 1 || stats.MaxReorderingExtent != 1 || stats.NReordering[0] == 0 || stats.NReordering[1] != 0 {
+		t.Errorf("%d reordered, max extent %d, n-reordering %v, expected 1, 1 and 1-reordering",
+			stats.Reordered, stats.MaxReorderingExtent, stats.NReordering)
+	}
+	if e.GetLate() != 1 || e.GetDuplicates() != 1 {
+		t.Errorf("%d late, %d duplicates, expected 1 and 1", e.GetLate(), e.GetDuplicates())
+	}
+}
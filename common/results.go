@@ -1,6 +1,7 @@
 package common
 
 import (
+	"fmt"
 	"log"
 	"math"
 	"time"
@@ -20,8 +21,66 @@ type TwampResult struct {
 	SenderTTL           byte      `json:"senderTTL"`
 	FinishedTimestamp   time.Time `json:"finishedTimestamp"`
 	SenderSize          int       `json:"senderSize"`
+	ReceiverSize        int       `json:"receiverSize"`
+	// TOS (DSCP and ECN) of the test packet received by the reflector (RFC 7750)
+	// and of the reflected packet received by the client, -1 when not known.
+	ForwardTOS      int  `json:"forwardTOS"`
+	ReverseTOS      int  `json:"reverseTOS"`
+	ForwardRemarked bool `json:"forwardRemarked"`
+	ReverseRemarked bool `json:"reverseRemarked"`
+	// Decoded Error Estimates of the reflector and of the sender timestamps
+	ReflectorClock ErrorEstimate `json:"reflectorClock"`
+	SenderClock    ErrorEstimate `json:"senderClock"`
+	// Reordering of the reflected packet (RFC 4737): its extent in received
+	// packets, its gap in Sequence Numbers behind the next expected one and the
+	// largest n for which it is n-reordered
+	Reordered        bool `json:"reordered"`
+	ReorderingExtent int  `json:"reorderingExtent,omitempty"`
+	ReorderingGap    int  `json:"reorderingGap,omitempty"`
+	ReorderingDegree int  `json:"reorderingDegree,omitempty"`
+	// Further copy of an already received reflected packet (RFC 5560)
+	Duplicate bool `json:"duplicate"`
 }
 
+/*
+Set the received TOS values and detect DSCP remarking against the TOS requested
+for the session. ECN is not compared as routers may legitimately mark congestion.
+*/
+func (r *TwampResult) SetTOS(requested int, forward int, reverse int) {
+	r.ForwardTOS = forward
+	r.ReverseTOS = reverse
+	r.ForwardRemarked = forward >= 0 && forward>>2 != requested>>2
+	r.ReverseRemarked = reverse >= 0 && reverse>>2 != requested>>2
+}
+
+/*
+Set the Error Estimates of the reflector and of the sender timestamps.
+*/
+func (r *TwampResult) SetErrorEstimates(errorEstimate uint16, senderErrorEstimate uint16) {
+	r.ErrorEstimate = errorEstimate
+	r.SenderErrorEstimate = senderErrorEstimate
+	r.ReflectorClock = NewErrorEstimate(errorEstimate)
+	r.SenderClock = NewErrorEstimate(senderErrorEstimate)
+}
+
+/*
+One-way delays are only meaningful when the clocks of both the sender and the
+reflector are synchronized.
+*/
+func (r *TwampResult) IsSynchronized() bool {
+	return r.SenderClock.Synchronized && r.ReflectorClock.Synchronized
+}
+
+/*
+Get the maximum error of a one-way delay: the sum of the errors of both clocks.
+*/
+func (r *TwampResult) GetMaxError() time.Duration {
+	return r.SenderClock.GetError() + r.ReflectorClock.GetError()
+}
+
+/*
+Get the time the test packet spent in the reflector (residence time).
+*/
 func (r *TwampResult) GetWait() time.Duration {
 	return r.Timestamp.Sub(r.ReceiveTimestamp)
 }
@@ -44,18 +103,241 @@ type PingResultStats struct {
 	Transmitted int           `json:"tx"`
 	Received    int           `json:"rx"`
 	Loss        float64       `json:"loss"`
+	// Number of received packets whose DSCP was changed on the way
+	ForwardRemarked int `json:"forwardRemarked"`
+	ReverseRemarked int `json:"reverseRemarked"`
+	// Number of reflected packets received after the loss threshold, their
+	// test packets are counted as lost
+	Late int `json:"late"`
+	// Reordered received packets (RFC 4737), their percentage of the received
+	// packets, the largest reordering extent and the percentage of n-reordered
+	// packets for n from 1 to MaxNReordering
+	Reordered           int       `json:"reordered"`
+	ReorderedRatio      float64   `json:"reorderedRatio"`
+	MaxReorderingExtent int       `json:"maxReorderingExtent"`
+	NReordering         []float64 `json:"nReordering,omitempty"`
+	nReordered          []int
+	// Duplicated reflected packets (RFC 5560) and their percentage of the
+	// transmitted packets
+	Duplicates     int     `json:"duplicates"`
+	DuplicateRatio float64 `json:"duplicateRatio"`
+	// One-way delays, reflector processing time and round-trip time without the
+	// processing time
+	Forward    DelayStats `json:"forward"`
+	Reverse    DelayStats `json:"reverse"`
+	Processing DelayStats `json:"processing"`
+	NetworkRTT DelayStats `json:"networkRTT"`
+	// One-way delays corrected by the estimated clock offset of the reflector
+	CorrectedForward CorrectedDelayStats `json:"correctedForward"`
+	CorrectedReverse CorrectedDelayStats `json:"correctedReverse"`
+	// Delay variation (IPDV, PDV and jitter) of the one-way delays and of the RTT
+	ForwardVariation DelayVariation `json:"forwardVariation"`
+	ReverseVariation DelayVariation `json:"reverseVariation"`
+	RTTVariation     DelayVariation `json:"rttVariation"`
+
+	// percentiles and histogram bucket bounds of the statistics
+	percentiles     []float64
+	histogramBounds []time.Duration
+
+	// online statistics, in bounded memory
+	rtt           DelayStats
+	forwardDelays delayAccumulator
+	reverseDelays delayAccumulator
+	rttDelays     delayAccumulator
+	recent        map[uint32]recentDelays
+	recentOrder   []uint32
+	clock         clockEstimator
+}
+
+/*
+Create the statistics of a test run with the given percentiles and histogram
+bucket bounds, the defaults when nil.
+*/
+func NewPingResultStats(percentiles []float64, histogramBounds []time.Duration) *PingResultStats {
+	return &PingResultStats{
+		percentiles:     append([]float64(nil), percentiles...),
+		histogramBounds: append([]time.Duration(nil), histogramBounds...),
+	}
 }
 
+/*
+Get the percentiles of the statistics.
+*/
+func (s *PingResultStats) getPercentiles() []float64 {
+	if len(s.percentiles) == 0 {
+		return defaultPercentiles
+	}
+	return s.percentiles
+}
+
+/*
+Get the histogram bucket bounds of the statistics.
+*/
+func (s *PingResultStats) getHistogramBounds() []time.Duration {
+	if len(s.histogramBounds) == 0 {
+		return defaultHistogramBounds
+	}
+	return s.histogramBounds
+}
+
+/*
+Count a received test packet in the statistics. The statistics are updated
+online, they do not need the results to be kept. Duplicates are not counted.
+*/
+func (s *PingResultStats) Count(r *TwampResult) {
+	if r.Duplicate {
+		return
+	}
+
+	s.Received++
+	s.rtt.add(r.GetRTT())
+	s.Min = s.rtt.Min
+	s.Max = s.rtt.Max
+	s.Avg = s.rtt.Avg
+	s.StdDev = s.rtt.StdDev
+
+	s.CountRemarking(r)
+	s.CountReordering(r)
+	s.CountDelays(r)
+}
+
+/*
+Count the DSCP remarking of a received test packet.
+*/
+func (s *PingResultStats) CountRemarking(r *TwampResult) {
+	if r.ForwardRemarked {
+		s.ForwardRemarked++
+	}
+	if r.ReverseRemarked {
+		s.ReverseRemarked++
+	}
+}
+
+/*
+Results kept by a test run: all of them, none, or a positive number of the last
+ones (a rolling window). The statistics always cover all results.
+*/
+const (
+	KeepAllResults = 0
+	KeepNoResults  = -1
+)
+
 type PingResults struct {
+	Mode    string           `json:"mode,omitempty"`
+	Sid     string           `json:"sid,omitempty"`
 	Results []*TwampResult   `json:"results"`
 	Stat    *PingResultStats `json:"stats"`
+	// Estimated clock offset of the reflector and the offsets of the
+	// minimum-delay samples it is based on
+	Clock   *ClockEstimate `json:"clock,omitempty"`
+	Offsets []OffsetSample `json:"offsets,omitempty"`
+	// Percentiles and histograms of the RTT and of the one-way delays
+	RTTDistribution     *Distribution `json:"rttDistribution,omitempty"`
+	ForwardDistribution *Distribution `json:"forwardDistribution,omitempty"`
+	ReverseDistribution *Distribution `json:"reverseDistribution,omitempty"`
+}
+
+/*
+Add a result to the kept results, keep is KeepAllResults, KeepNoResults or the
+size of the rolling window.
+*/
+func (r *PingResults) AddResult(result *TwampResult, keep int) {
+	switch {
+	case keep == KeepAllResults:
+		r.Results = append(r.Results, result)
+	case keep > 0:
+		r.Results = append(r.Results, result)
+		if len(r.Results) > keep {
+			r.Results = r.Results[len(r.Results)-keep:]
+		}
+	}
 }
 
+/*
+Compute the statistics only needed at the end of a test run: the clock estimate,
+the delay variations and the distributions. The others are updated online as the
+results are counted.
+*/
+func (r *PingResults) UpdateStats() {
+	r.UpdateClockEstimate()
+	r.UpdateDelayVariation()
+	r.UpdateDistributions()
+}
+
+/*
+Print the statistics of a ping test: loss, late, duplicated and reordered
+packets, the RTT and one-way delays, the clock estimate, the delay variations,
+the percentiles and histograms and the DSCP remarking.
+*/
+func (r *PingResults) PrintStats(lossThreshold time.Duration) {
+	Stats := r.Stat
+
+	fmt.Printf("%d packets transmitted, %d packets received, %0.1f%% packet loss\n",
+		Stats.Transmitted,
+		Stats.Received,
+		Stats.Loss)
+	if Stats.Late > 0 {
+		fmt.Printf("%d packets received after the %s loss threshold\n", Stats.Late, lossThreshold)
+	}
+	if Stats.Duplicates > 0 {
+		fmt.Printf("%d duplicated packets, %0.1f%% duplication\n", Stats.Duplicates, Stats.DuplicateRatio)
+	}
+	if Stats.Reordered > 0 {
+		fmt.Printf("%d packets reordered, %0.1f%% reordering, max extent %d\n", Stats.Reordered, Stats.ReorderedRatio, Stats.MaxReorderingExtent)
+	}
+	fmt.Printf("round-trip min/avg/max/stddev = %0.3f/%0.3f/%0.3f/%0.3f ms\n",
+		(float64(Stats.Min) / float64(time.Millisecond)),
+		(float64(Stats.Avg) / float64(time.Millisecond)),
+		(float64(Stats.Max) / float64(time.Millisecond)),
+		(float64(Stats.StdDev) / float64(time.Millisecond)),
+	)
+	fmt.Printf("network round-trip min/avg/max/stddev = %s\n", Stats.NetworkRTT)
+	fmt.Printf("forward delay min/avg/max/stddev = %s\n", Stats.Forward)
+	fmt.Printf("reverse delay min/avg/max/stddev = %s\n", Stats.Reverse)
+	if r.Clock != nil {
+		fmt.Printf("reflector clock %s\n", r.Clock)
+		fmt.Printf("corrected forward delay avg/stddev = %s\n", Stats.CorrectedForward)
+		fmt.Printf("corrected reverse delay avg/stddev = %s\n", Stats.CorrectedReverse)
+	}
+	fmt.Printf("jitter forward/reverse/round-trip = %0.3f/%0.3f/%0.3f ms\n",
+		(float64(Stats.ForwardVariation.Jitter) / float64(time.Millisecond)),
+		(float64(Stats.ReverseVariation.Jitter) / float64(time.Millisecond)),
+		(float64(Stats.RTTVariation.Jitter) / float64(time.Millisecond)),
+	)
+	fmt.Printf("forward ipdv %s\n", Stats.ForwardVariation.IPDV)
+	fmt.Printf("forward pdv %s\n", Stats.ForwardVariation.PDV)
+	fmt.Printf("reverse ipdv %s\n", Stats.ReverseVariation.IPDV)
+	fmt.Printf("reverse pdv %s\n", Stats.ReverseVariation.PDV)
+	if r.RTTDistribution != nil {
+		fmt.Printf("round-trip %s\n", r.RTTDistribution)
+		fmt.Printf("forward delay %s\n", r.ForwardDistribution)
+		fmt.Printf("reverse delay %s\n", r.ReverseDistribution)
+		fmt.Printf("round-trip histogram %s\n", r.RTTDistribution.Histogram)
+		fmt.Printf("forward delay histogram %s\n", r.ForwardDistribution.Histogram)
+		fmt.Printf("reverse delay histogram %s\n", r.ReverseDistribution.Histogram)
+	}
+	if Stats.ForwardRemarked > 0 || Stats.ReverseRemarked > 0 {
+		fmt.Printf("DSCP remarked on %d forward and %d reverse packets\n", Stats.ForwardRemarked, Stats.ReverseRemarked)
+	}
+}
+
+/*
+Standard deviation of the RTT of the kept results, duplicates are not counted.
+The statistics have it for all results.
+*/
 func (r *PingResults) StdDev(mean time.Duration) time.Duration {
 	total := float64(0)
+	count := 0
 	for _, result := range r.Results {
+		if result.Duplicate {
+			continue
+		}
 		total += math.Pow(float64(result.GetRTT()-mean), 2)
+		count++
+	}
+	if count < 2 {
+		return 0
 	}
-	variance := total / float64(len(r.Results)-1)
+	variance := total / float64(count-1)
 	return time.Duration(math.Sqrt(variance))
 }
@@ -20,9 +20,62 @@ type TwampSessionConfig struct {
 	// be considered lost if it is not received during Timeout seconds
 	// after it is sent.
 	Timeout int
-	TOS     int
+	// Timeout with sub-second precision, used instead of Timeout when set.
+	TimeoutDuration time.Duration
+	TOS             int
 	// If true, padding will be filled with zeros instead of random data.
 	UseAllZeros bool
 	// Interval between sending out two measurement packet
 	Interval time.Duration
+	// According to RFC 6038 (Reflect Octets), Octets to be reflected are
+	// returned by the server in Accept-Session, and the first Length of padding
+	// to reflect octets of the Session-Sender padding are copied into the
+	// Session-Reflector packets, where the client checks them.
+	OctetsToReflect  uint16
+	PaddingToReflect int
+	// According to RFC 6038 (Symmetrical Size), the Session-Sender and the
+	// Session-Reflector packets have the same size. The padding is increased
+	// when it is too short for that.
+	SymmetricalSize bool
+	// According to RFC 8972, the Session-Sender Identifier (SSID) identifies
+	// the STAMP test session on the Session-Reflector.
+	SSID uint16
+	// Format of the timestamps sent by the Session-Sender, NTP by default.
+	// According to RFC 8186, the Z flag of the Error Estimate tells the
+	// format of the timestamp sent with it.
+	TimestampFormat TimestampFormat
+	// If true, the reflected packets are timestamped by the kernel when they
+	// arrive (SO_TIMESTAMPNS), which removes the scheduling delay of the
+	// reader from the round-trip time. Only available on Linux.
+	KernelTimestamps bool
+	// Results kept by a test run: all of them (KeepAllResults), none
+	// (KeepNoResults) or the given number of the last ones. The statistics
+	// are computed online, so long tests run in bounded memory without them.
+	KeepResults int
+	// Percentiles of the delays and upper bounds of the delay histogram
+	// buckets in the statistics. The defaults are used when nil.
+	Percentiles     []float64
+	HistogramBounds []time.Duration
+}
+
+/*
+Get the session Timeout, with sub-second precision when TimeoutDuration is set.
+*/
+func (c TwampSessionConfig) GetTimeout() time.Duration {
+	if c.TimeoutDuration > 0 {
+		return c.TimeoutDuration
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+/*
+Get the time after which a test packet without reflected packet is considered
+lost: the session Timeout, or DefaultTimeout when the session has none.
+*/
+func (c TwampSessionConfig) GetLossThreshold() time.Duration {
+	timeout := c.GetTimeout()
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+	return timeout
 }
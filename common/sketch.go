@@ -0,0 +1,136 @@
+package common
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+/*
+Relative error of the percentiles computed by the quantile sketch.
+*/
+const sketchRelativeError = 0.001
+
+/*
+Streaming quantile sketch of delays with logarithmic buckets, as DDSketch. A
+delay d > 0 is counted in the bucket i = ceil(log_gamma(d)), negative delays in
+the buckets of their absolute value and zero delays apart, so every percentile is
+within sketchRelativeError of the actual delay. The number of buckets only grows
+with the logarithm of the delay range, so its memory is bounded whatever the
+number of delays.
+*/
+type quantileSketch struct {
+	count    int
+	zero     int
+	positive map[int]int
+	negative map[int]int
+	min      time.Duration
+	max      time.Duration
+}
+
+var sketchGamma = (1 + sketchRelativeError) / (1 - sketchRelativeError)
+
+func (s *quantileSketch) add(delay time.Duration) {
+	if s.positive == nil {
+		s.positive = map[int]int{}
+		s.negative = map[int]int{}
+	}
+
+	if s.count == 0 || s.min > delay {
+		s.min = delay
+	}
+	if s.max < delay {
+		s.max = delay
+	}
+	s.count++
+
+	switch {
+	case delay > 0:
+		s.positive[sketchIndex(float64(delay))]++
+	case delay < 0:
+		s.negative[sketchIndex(float64(-delay))]++
+	default:
+		s.zero++
+	}
+}
+
+func sketchIndex(value float64) int {
+	return int(math.Ceil(math.Log(value) / math.Log(sketchGamma)))
+}
+
+/*
+Value representing a bucket: its relative error to every value of the bucket is
+at most sketchRelativeError.
+*/
+func sketchValue(index int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
+
+/*
+Get the nearest-rank percentile p (0 to 100) of the delays.
+*/
+func (s *quantileSketch) percentile(p float64) time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+
+	// the tolerance keeps exact ranks like 99.9% of 1000 from rounding up
+	rank := int(math.Ceil(p/100*float64(s.count) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+
+	// the negative delays come first, the largest absolute values first
+	value := float64(s.max)
+	negative := sortedKeys(s.negative)
+	positive := sortedKeys(s.positive)
+	for i := len(negative) - 1; i >= 0; i-- {
+		rank -= s.negative[negative[i]]
+		if rank <= 0 {
+			value = -sketchValue(negative[i])
+			break
+		}
+	}
+	if rank > 0 {
+		rank -= s.zero
+		if rank <= 0 {
+			value = 0
+		}
+	}
+	for i := 0; rank > 0 && i < len(positive); i++ {
+		rank -= s.positive[positive[i]]
+		if rank <= 0 {
+			value = sketchValue(positive[i])
+		}
+	}
+
+	// the extremes are known exactly
+	delay := time.Duration(math.Round(value))
+	if delay < s.min {
+		delay = s.min
+	}
+	if delay > s.max {
+		delay = s.max
+	}
+	return delay
+}
+
+/*
+Get the given percentiles of the delays by their names.
+*/
+func (s *quantileSketch) percentiles(percentiles []float64) map[string]time.Duration {
+	values := map[string]time.Duration{}
+	for _, p := range percentiles {
+		values[percentileName(p)] = s.percentile(p)
+	}
+	return values
+}
+
+func sortedKeys(buckets map[int]int) []int {
+	keys := make([]int, 0, len(buckets))
+	for key := range buckets {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
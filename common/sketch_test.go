@@ -0,0 +1,123 @@
+package common
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+/*
+Exact nearest-rank percentile of sorted delays.
+*/
+func exactPercentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p/100*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func TestQuantileSketchRelativeError(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	uniform := func(low, high time.Duration) time.Duration {
+		return low + time.Duration(random.Int63n(int64(high-low)))
+	}
+
+	tests := []struct {
+		name   string
+		delays func() []time.Duration
+	}{
+		{"uniform", func() []time.Duration {
+			delays := []time.Duration{}
+			for i := 0; i < 10000; i++ {
+				delays = append(delays, uniform(time.Millisecond, 1100*time.Microsecond))
+			}
+			return delays
+		}},
+		{"outlier first", func() []time.Duration {
+			delays := []time.Duration{300 * time.Millisecond}
+			for i := 0; i < 10000; i++ {
+				delays = append(delays, uniform(time.Millisecond, 1100*time.Microsecond))
+			}
+			return delays
+		}},
+		{"exponential", func() []time.Duration {
+			delays := []time.Duration{}
+			for i := 0; i < 10000; i++ {
+				delays = append(delays, time.Duration(random.ExpFloat64()*float64(5*time.Millisecond)))
+			}
+			return delays
+		}},
+		{"wide range", func() []time.Duration {
+			delays := []time.Duration{}
+			for i := 0; i < 10000; i++ {
+				delays = append(delays, time.Duration(math.Pow(10, 3+6*random.Float64())))
+			}
+			return delays
+		}},
+		{"negative and zero", func() []time.Duration {
+			delays := []time.Duration{}
+			for i := 0; i < 10000; i++ {
+				delays = append(delays, uniform(-2*time.Millisecond, time.Millisecond))
+			}
+			for i := 0; i < 100; i++ {
+				delays = append(delays, 0)
+			}
+			return delays
+		}},
+	}
+
+	percentiles := []float64{0, 1, 10, 25, 50, 75, 90, 95, 99, 99.9, 100}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delays := test.delays()
+			sketch := quantileSketch{}
+			for _, delay := range delays {
+				sketch.add(delay)
+			}
+
+			sorted := append([]time.Duration{}, delays...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+			for _, p := range percentiles {
+				exact := exactPercentile(sorted, p)
+				estimate := sketch.percentile(p)
+
+				// one nanosecond for the rounding of the estimate
+				bound := sketchRelativeError*math.Abs(float64(exact)) + 1
+				if math.Abs(float64(estimate-exact)) > bound {
+					t.Errorf("p%v = %s, expected %s within %0.1f%%", p, estimate, exact, sketchRelativeError*100)
+				}
+				if estimate < sorted[0] || estimate > sorted[len(sorted)-1] {
+					t.Errorf("p%v = %s outside of [%s, %s]", p, estimate, sorted[0], sorted[len(sorted)-1])
+				}
+			}
+		})
+	}
+}
+
+func TestQuantileSketchEmpty(t *testing.T) {
+	sketch := quantileSketch{}
+	if p := sketch.percentile(50); p != 0 {
+		t.Errorf("p50 of no delays = %s, expected 0", p)
+	}
+}
+
+func TestQuantileSketchPercentiles(t *testing.T) {
+	sketch := quantileSketch{}
+	for i := 1; i <= 1000; i++ {
+		sketch.add(time.Duration(i) * time.Millisecond)
+	}
+
+	values := sketch.percentiles([]float64{50, 99.9})
+	if len(values) != 2 {
+		t.Fatalf("got %d percentiles, expected 2", len(values))
+	}
+	for name, expected := range map[string]time.Duration{"p50": 500 * time.Millisecond, "p99.9": 999 * time.Millisecond} {
+		if math.Abs(float64(values[name]-expected)) > sketchRelativeError*float64(expected) {
+			t.Errorf("%s = %s, expected %s", name, values[name], expected)
+		}
+	}
+}
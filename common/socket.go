@@ -0,0 +1,109 @@
+package common
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"time"
+)
+
+/*
+Size of the buffer receiving the socket control messages of a test packet.
+*/
+const oobSize = 128
+
+/*
+Check whether the UDP connection may carry IPv6 packets. Sockets bound to the
+unspecified IPv6 address are dual-stack and carry IPv4 packets as well.
+*/
+func isIPv6(conn *net.UDPConn) bool {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	return ok && addr.IP.To4() == nil
+}
+
+/*
+Set the IP TTL (Hop Limit in IPv6) and the TOS (Traffic Class in IPv6) of the
+packets sent on the UDP connection.
+*/
+func SetPacketOptions(conn *net.UDPConn, ttl int, tos int) error {
+	if !isIPv6(conn) {
+		c := ipv4.NewConn(conn)
+		err := c.SetTTL(ttl)
+		if err != nil {
+			return err
+		}
+		return c.SetTOS(tos)
+	}
+
+	c := ipv6.NewConn(conn)
+	err := c.SetHopLimit(ttl)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetTrafficClass(tos)
+	if err != nil {
+		return err
+	}
+
+	// dual-stack sockets send IPv4 packets too
+	c4 := ipv4.NewConn(conn)
+	c4.SetTTL(ttl)
+	c4.SetTOS(tos)
+
+	return nil
+}
+
+/*
+Send a packet with the given TOS (Traffic Class in IPv6) instead of the one of
+the UDP connection, which is kept when the TOS is negative. The TOS of IPv4
+packets is only set on Linux.
+*/
+func WriteWithTOS(conn *net.UDPConn, buf []byte, addr *net.UDPAddr, tos int) (int, error) {
+	n, _, err := conn.WriteMsgUDP(buf, tosControlMessage(addr, tos), addr)
+	return n, err
+}
+
+/*
+Ask the kernel to report the TTL (Hop Limit in IPv6) of the received packets.
+*/
+func EnableReceiveTTL(conn *net.UDPConn) error {
+	err4 := ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagTTL, true)
+	err6 := ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagHopLimit, true)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+/*
+IP header fields of a received packet, as reported by the kernel. Fields which
+are not reported are -1.
+*/
+type PacketInfo struct {
+	TTL int // TTL, Hop Limit in IPv6
+	TOS int // TOS, Traffic Class in IPv6: DSCP and ECN
+	// Receive timestamp taken by the kernel when enabled with
+	// EnableReceiveTimestamp, otherwise the time the read returned.
+	Timestamp time.Time
+}
+
+/*
+Read a packet together with the IP header fields enabled by EnableReceiveTTL and
+EnableReceiveTOS, and the receive timestamp enabled by EnableReceiveTimestamp.
+*/
+func ReadWithInfo(conn *net.UDPConn, buf []byte) (int, PacketInfo, *net.UDPAddr, error) {
+	oob := make([]byte, oobSize)
+	n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+	received := time.Now()
+	if err != nil {
+		return n, PacketInfo{TTL: -1, TOS: -1, Timestamp: received}, addr, err
+	}
+
+	info := parseControlMessages(oob[:oobn])
+	if info.Timestamp.IsZero() {
+		info.Timestamp = received
+	}
+
+	return n, info, addr, nil
+}
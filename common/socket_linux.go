@@ -0,0 +1,116 @@
+//go:build linux
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+	"unsafe"
+)
+
+/*
+Ask the kernel to report the TOS (Traffic Class in IPv6) of the received packets.
+*/
+func EnableReceiveTOS(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var err4, err6 error
+	err = raw.Control(func(fd uintptr) {
+		err4 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		err6 = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+/*
+Ask the kernel to timestamp the received packets (SO_TIMESTAMPNS). The timestamp
+is taken when the packet arrives, without the scheduling delay of the reader.
+*/
+func EnableReceiveTimestamp(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errTimestamp error
+	err = raw.Control(func(fd uintptr) {
+		errTimestamp = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	return errTimestamp
+}
+
+/*
+Build the IP_TOS (IPV6_TCLASS for IPv6 destinations) control message setting the
+TOS of a sent packet, none when the TOS is negative. Dual-stack sockets send
+IPv4 packets with IPv4 control messages.
+*/
+func tosControlMessage(addr *net.UDPAddr, tos int) []byte {
+	if tos < 0 {
+		return nil
+	}
+
+	level, messageType := unix.IPPROTO_IPV6, unix.IPV6_TCLASS
+	if addr.IP.To4() != nil {
+		level, messageType = unix.IPPROTO_IP, unix.IP_TOS
+	}
+
+	oob := make([]byte, unix.CmsgSpace(4))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = int32(level)
+	header.Type = int32(messageType)
+	header.SetLen(unix.CmsgLen(4))
+	binary.NativeEndian.PutUint32(oob[unix.CmsgLen(0):], uint32(tos))
+
+	return oob
+}
+
+/*
+Get the TTL, TOS and receive timestamp of a received packet from its socket
+control messages. Dual-stack sockets report IPv4 packets with IPv4 control
+messages.
+*/
+func parseControlMessages(oob []byte) PacketInfo {
+	info := PacketInfo{TTL: -1, TOS: -1}
+
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return info
+	}
+
+	for _, m := range messages {
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TTL && len(m.Data) >= 4:
+			info.TTL = int(binary.NativeEndian.Uint32(m.Data))
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) >= 1:
+			info.TOS = int(m.Data[0])
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_HOPLIMIT && len(m.Data) >= 4:
+			info.TTL = int(binary.NativeEndian.Uint32(m.Data))
+		case m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS && len(m.Data) >= 4:
+			info.TOS = int(binary.NativeEndian.Uint32(m.Data))
+		case m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS:
+			timestamp := unix.Timespec{}
+			if binary.Read(bytes.NewReader(m.Data), binary.NativeEndian, &timestamp) == nil {
+				info.Timestamp = time.Unix(int64(timestamp.Sec), int64(timestamp.Nsec))
+			}
+		}
+	}
+
+	return info
+}
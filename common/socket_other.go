@@ -0,0 +1,58 @@
+//go:build !linux
+
+package common
+
+import (
+	"errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+)
+
+/*
+Ask the kernel to report the Traffic Class of the received IPv6 packets. The TOS
+of IPv4 packets is only reported on Linux.
+*/
+func EnableReceiveTOS(conn *net.UDPConn) error {
+	return ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagTrafficClass, true)
+}
+
+/*
+Ask the kernel to timestamp the received packets. It is only available on Linux,
+elsewhere the packets are timestamped when the read returns.
+*/
+func EnableReceiveTimestamp(conn *net.UDPConn) error {
+	return errors.New("Kernel receive timestamps are only available on Linux.")
+}
+
+/*
+Build the control message setting the Traffic Class of a sent IPv6 packet, none
+when the TOS is negative. The TOS of IPv4 packets is only set on Linux.
+*/
+func tosControlMessage(addr *net.UDPAddr, tos int) []byte {
+	if tos < 0 || addr.IP.To4() != nil {
+		return nil
+	}
+	return (&ipv6.ControlMessage{TrafficClass: tos}).Marshal()
+}
+
+/*
+Get the TTL and TOS of a received packet from its socket control messages.
+*/
+func parseControlMessages(oob []byte) PacketInfo {
+	info := PacketInfo{TTL: -1, TOS: -1}
+
+	cm4 := &ipv4.ControlMessage{}
+	if cm4.Parse(oob) == nil && cm4.TTL != 0 {
+		info.TTL = cm4.TTL
+		return info
+	}
+
+	cm6 := &ipv6.ControlMessage{}
+	if cm6.Parse(oob) == nil && cm6.HopLimit != 0 {
+		info.TTL = cm6.HopLimit
+		info.TOS = cm6.TrafficClass
+	}
+
+	return info
+}
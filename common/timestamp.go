@@ -9,30 +9,102 @@ type TwampTimestamp struct {
 	Fraction uint32
 }
 
+/*
+Format of the timestamps of the test packets, signalled by the Z flag of the
+Error Estimate (RFC 8186, RFC 8762).
+*/
+type TimestampFormat int
+
+const (
+	// NTP 64-bit format: seconds since 1900 and fraction in units of 2^-32 seconds
+	TimestampNTP TimestampFormat = 0
+	// IEEE 1588 PTP truncated format: TAI seconds since 1970 and nanoseconds
+	TimestampPTP TimestampFormat = 1
+)
+
+/*
+Z flag of the Error Estimate, set when the timestamp has the PTP format.
+*/
+const ErrorEstimateZ = 0x4000
+
+/*
+Seconds between the NTP epoch (1900) and the UNIX epoch (1970).
+*/
+const ntpEpochOffset = 2208988800
+
+/*
+Offset of TAI, the timescale of PTP, from UTC. It changes with leap seconds.
+*/
+var TaiUtcOffset = 37 * time.Second
+
 /*
 Converts a UNIX epoch time time.Time object into an RFC 1305 compliant time.
 */
 func NewTwampTimestamp(t time.Time) *TwampTimestamp {
-	// convert epoch from 1970 to 1900 per RFC 1305
-	t = t.AddDate(70, 0, 0)
+	return NewTwampTimestampFormat(t, TimestampNTP)
+}
+
+/*
+Converts a UNIX epoch time time.Time object into a timestamp of the given format.
+*/
+func NewTwampTimestampFormat(t time.Time, format TimestampFormat) *TwampTimestamp {
+	if format == TimestampPTP {
+		t = t.Add(TaiUtcOffset)
+		return &TwampTimestamp{
+			Integer:  uint32(t.Unix()),
+			Fraction: uint32(t.Nanosecond()),
+		}
+	}
+
+	// the fraction is rounded to the nearest 2^-32 seconds
 	return &TwampTimestamp{
-		Integer:  uint32(t.Unix()),
-		Fraction: uint32(t.Nanosecond()),
+		Integer:  uint32(t.Unix() + ntpEpochOffset),
+		Fraction: uint32((uint64(t.Nanosecond())<<32 + 500000000) / 1000000000),
 	}
 }
 
 func NewTimestamp(twampTimestamp TwampTimestamp) time.Time {
-	t := time.Unix(int64(twampTimestamp.Integer), int64(twampTimestamp.Fraction))
-	t = t.AddDate(-70, 0, 0) // convert epoch from 1970 to 1900 per RFC 1305
-	return t
+	return NewTimestampFormat(twampTimestamp, TimestampNTP)
+}
+
+/*
+Converts a timestamp of the given format into a UNIX epoch time time.Time object.
+*/
+func NewTimestampFormat(twampTimestamp TwampTimestamp, format TimestampFormat) time.Time {
+	if format == TimestampPTP {
+		return time.Unix(int64(twampTimestamp.Integer), int64(twampTimestamp.Fraction)).Add(-TaiUtcOffset)
+	}
+
+	// the nanoseconds are rounded as well, so conversions round-trip
+	nanoseconds := (uint64(twampTimestamp.Fraction)*1000000000 + 1<<31) >> 32
+	return time.Unix(int64(twampTimestamp.Integer)-ntpEpochOffset, int64(nanoseconds))
+}
+
+/*
+Get the format of a timestamp from the Z flag of the Error Estimate sent with it.
+*/
+func TimestampFormatOf(errorEstimate uint16) TimestampFormat {
+	if errorEstimate&ErrorEstimateZ != 0 {
+		return TimestampPTP
+	}
+	return TimestampNTP
+}
+
+/*
+Set the Z flag of an Error Estimate to the format of the timestamp sent with it.
+*/
+func SetTimestampFormat(errorEstimate uint16, format TimestampFormat) uint16 {
+	if format == TimestampPTP {
+		return errorEstimate | ErrorEstimateZ
+	}
+	return errorEstimate &^ ErrorEstimateZ
 }
 
 /*
 Return a time.Time object representing Unix Epoch time since January 1st, 1970.
 */
 func (t *TwampTimestamp) GetTime() time.Time {
-	// convert epoch from 1900 back to 1970
-	return time.Unix(int64(t.Integer), int64(t.Fraction)).AddDate(-70, 0, 0)
+	return NewTimestamp(*t)
 }
 
 func (t *TwampTimestamp) String() string {
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		time      time.Time
+		timestamp TwampTimestamp
+	}{
+		{"UNIX epoch", time.Unix(0, 0), TwampTimestamp{ntpEpochOffset, 0}},
+		{"one nanosecond", time.Unix(0, 1), TwampTimestamp{ntpEpochOffset, 4}},
+		{"half second", time.Unix(0, 500000000), TwampTimestamp{ntpEpochOffset, 0x80000000}},
+		{"last nanosecond", time.Unix(1, 999999999), TwampTimestamp{ntpEpochOffset + 1, 0xfffffffc}},
+		{"NTP era 0 end", time.Unix(1<<32-1-ntpEpochOffset, 0), TwampTimestamp{0xffffffff, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timestamp := NewTwampTimestamp(test.time)
+			if *timestamp != test.timestamp {
+				t.Errorf("converted %s to %+v, expected %+v", test.time, *timestamp, test.timestamp)
+			}
+			if back := NewTimestamp(*timestamp); !back.Equal(test.time) {
+				t.Errorf("converted back to %s, expected %s", back, test.time)
+			}
+		})
+	}
+}
+
+func TestNTPFraction(t *testing.T) {
+	tests := []struct {
+		fraction    uint32
+		nanoseconds int64 // nanoseconds since the NTP second
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, 1},
+		{0x80000000, 500000000},
+		{0xfffffffb, 999999999},
+		// rounded up to the next second
+		{0xffffffff, 1000000000},
+	}
+
+	for _, test := range tests {
+		second := time.Unix(1000, 0)
+		converted := NewTimestamp(TwampTimestamp{Integer: 1000 + ntpEpochOffset, Fraction: test.fraction})
+		if nanoseconds := converted.Sub(second).Nanoseconds(); nanoseconds != test.nanoseconds {
+			t.Errorf("fraction %#x converted to %d ns, expected %d ns", test.fraction, nanoseconds, test.nanoseconds)
+		}
+	}
+}
+
+func TestTimestampRoundTrip(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	for _, format := range []TimestampFormat{TimestampNTP, TimestampPTP} {
+		for i := 0; i < 100000; i++ {
+			original := time.Unix(1700000000+random.Int63n(1000000), random.Int63n(int64(time.Second)))
+			converted := NewTimestampFormat(*NewTwampTimestampFormat(original, format), format)
+			if !converted.Equal(original) {
+				t.Fatalf("format %d: %s converted back to %s", format, original, converted)
+			}
+		}
+	}
+}
+
+func TestPTPTimestamp(t *testing.T) {
+	original := time.Unix(1700000000, 999999999)
+	timestamp := NewTwampTimestampFormat(original, TimestampPTP)
+
+	// TAI seconds since 1970 and nanoseconds (RFC 8186 section 2.1)
+	expected := TwampTimestamp{Integer: uint32(1700000000 + TaiUtcOffset/time.Second), Fraction: 999999999}
+	if *timestamp != expected {
+		t.Errorf("converted %s to %+v, expected %+v", original, *timestamp, expected)
+	}
+}
+
+func TestTimestampFormatFlag(t *testing.T) {
+	tests := []struct {
+		errorEstimate uint16
+		format        TimestampFormat
+		expected      uint16
+	}{
+		{0x8001, TimestampNTP, 0x8001},
+		{0x8001, TimestampPTP, 0xc001},
+		{0xc001, TimestampNTP, 0x8001},
+		{0xc001, TimestampPTP, 0xc001},
+	}
+
+	for _, test := range tests {
+		errorEstimate := SetTimestampFormat(test.errorEstimate, test.format)
+		if errorEstimate != test.expected {
+			t.Errorf("set format %d on %#x: %#x, expected %#x", test.format, test.errorEstimate, errorEstimate, test.expected)
+		}
+		if format := TimestampFormatOf(errorEstimate); format != test.format {
+			t.Errorf("format of %#x is %d, expected %d", errorEstimate, format, test.format)
+		}
+	}
+}
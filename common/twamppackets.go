@@ -1,5 +1,15 @@
 package common
 
+/*
+Session-Sender test packet in unauthenticated mode (RFC 5357 section 4.1.2).
+*/
+type TestPacket struct {
+	Sequence      uint32
+	Timestamp     TwampTimestamp
+	ErrorEstimate uint16
+	//Padding []byte
+}
+
 type MeasurementPacket struct {
 	Sequence            uint32
 	Timestamp           TwampTimestamp
@@ -13,3 +23,39 @@ type MeasurementPacket struct {
 	SenderTtl           byte
 	//Padding []byte
 }
+
+/*
+Session-Sender test packet in authenticated and encrypted modes (RFC 5357 section 4.1.2).
+*/
+type AuthenticatedTestPacket struct {
+	Sequence      uint32
+	MBZ           [12]byte
+	Timestamp     TwampTimestamp
+	ErrorEstimate uint16
+	Mbz           [6]byte
+	HMAC          [16]byte
+	//Padding []byte
+}
+
+/*
+Session-Reflector test packet in authenticated and encrypted modes (RFC 5357 section 4.2.1).
+*/
+type AuthenticatedMeasurementPacket struct {
+	Sequence            uint32
+	MBZ1                [12]byte
+	Timestamp           TwampTimestamp
+	ErrorEstimate       uint16
+	MBZ2                [6]byte
+	ReceiveTimeStamp    TwampTimestamp
+	MBZ3                [8]byte
+	SenderSequence      uint32
+	MBZ4                [12]byte
+	SenderTimeStamp     TwampTimestamp
+	SenderErrorEstimate uint16
+	MBZ5                [6]byte
+	SenderTtl           byte
+	SenderDscpEcn       byte // DSCP and ECN received by the reflector (RFC 7750)
+	MBZ6                [14]byte
+	HMAC                [16]byte
+	//Padding []byte
+}
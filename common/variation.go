@@ -0,0 +1,185 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+Minimum, mean, maximum and percentiles of a delay variation.
+*/
+type VariationStats struct {
+	Min         time.Duration            `json:"min"`
+	Mean        time.Duration            `json:"mean"`
+	Max         time.Duration            `json:"max"`
+	Percentiles map[string]time.Duration `json:"percentiles,omitempty"`
+}
+
+/*
+Delay variation of a direction: IPDV (RFC 3393), the delay difference of packets
+of consecutive Sequence Numbers, negative when the later packet is faster, PDV
+(RFC 5481), the delay above the minimum delay, and the smoothed interarrival
+jitter of RFC 3550.
+*/
+type DelayVariation struct {
+	IPDV   VariationStats `json:"ipdv"`
+	PDV    VariationStats `json:"pdv"`
+	Jitter time.Duration  `json:"jitter"`
+}
+
+/*
+Format the statistics as min/mean/max and percentiles in milliseconds.
+*/
+func (s VariationStats) String() string {
+	return fmt.Sprintf("min/mean/max = %0.3f/%0.3f/%0.3f ms, %s",
+		(float64(s.Min) / float64(time.Millisecond)),
+		(float64(s.Mean) / float64(time.Millisecond)),
+		(float64(s.Max) / float64(time.Millisecond)),
+		formatPercentiles(s.Percentiles),
+	)
+}
+
+/*
+Online statistics of a delay: its distribution, IPDV and jitter, in bounded
+memory.
+*/
+type delayAccumulator struct {
+	delays     DelayStats
+	sketch     quantileSketch
+	histogram  Histogram
+	ipdv       DelayStats
+	ipdvSketch quantileSketch
+	jitter     float64
+	previous   time.Duration
+}
+
+/*
+Add a delay in arrival order.
+*/
+func (a *delayAccumulator) add(delay time.Duration) {
+	// RFC 3550 jitter follows the arrival order
+	if a.delays.count > 0 {
+		difference := math.Abs(float64(delay - a.previous))
+		a.jitter += (difference - a.jitter) / 16
+	}
+	a.previous = delay
+
+	a.delays.add(delay)
+	a.sketch.add(delay)
+	a.histogram.add(delay)
+}
+
+/*
+Add the IPDV of two packets of consecutive Sequence Numbers: the delay of the
+later packet minus the delay of the earlier one.
+*/
+func (a *delayAccumulator) addIPDV(difference time.Duration) {
+	a.ipdv.add(difference)
+	a.ipdvSketch.add(difference)
+}
+
+/*
+Get the delay variation. PDV is the delay above the minimum delay, its statistics
+follow from the ones of the delay, so its percentiles are within
+sketchRelativeError of the delay.
+*/
+func (a *delayAccumulator) variation(percentiles []float64) DelayVariation {
+	v := DelayVariation{Jitter: time.Duration(a.jitter)}
+
+	if a.ipdv.count > 0 {
+		v.IPDV = VariationStats{
+			Min:         a.ipdv.Min,
+			Mean:        a.ipdv.Avg,
+			Max:         a.ipdv.Max,
+			Percentiles: a.ipdvSketch.percentiles(percentiles),
+		}
+	}
+
+	if a.delays.count > 0 {
+		v.PDV = VariationStats{
+			Mean:        a.delays.Avg - a.delays.Min,
+			Max:         a.delays.Max - a.delays.Min,
+			Percentiles: map[string]time.Duration{},
+		}
+		for name, delay := range a.sketch.percentiles(percentiles) {
+			v.PDV.Percentiles[name] = delay - a.delays.Min
+		}
+	}
+
+	return v
+}
+
+/*
+Get the percentiles and histogram of the delay, nil without delays.
+*/
+func (a *delayAccumulator) distribution(percentiles []float64) *Distribution {
+	if a.delays.count == 0 {
+		return nil
+	}
+
+	return &Distribution{
+		Percentiles: a.sketch.percentiles(percentiles),
+		Histogram: Histogram{
+			Bounds: a.histogram.Bounds,
+			Counts: append([]int{}, a.histogram.Counts...),
+		},
+	}
+}
+
+/*
+Delays of a received test packet, kept for a while to compute the IPDV with the
+packets of the neighbouring Sequence Numbers.
+*/
+type recentDelays struct {
+	forward time.Duration
+	reverse time.Duration
+	rtt     time.Duration
+}
+
+/*
+Count the IPDV of a received test packet with the test packets of the previous
+and of the next Sequence Numbers received before it. IPDV is only defined for
+packets of consecutive Sequence Numbers (RFC 3393).
+*/
+func (s *PingResultStats) countIPDV(r *TwampResult) {
+	if s.recent == nil {
+		s.recent = map[uint32]recentDelays{}
+	}
+
+	delays := recentDelays{
+		forward: r.GetForwardDelay(),
+		reverse: r.GetReverseDelay(),
+		rtt:     r.GetRTT(),
+	}
+
+	if previous, ok := s.recent[r.SenderSeqNum-1]; ok {
+		s.forwardDelays.addIPDV(delays.forward - previous.forward)
+		s.reverseDelays.addIPDV(delays.reverse - previous.reverse)
+		s.rttDelays.addIPDV(delays.rtt - previous.rtt)
+	}
+	if next, ok := s.recent[r.SenderSeqNum+1]; ok {
+		s.forwardDelays.addIPDV(next.forward - delays.forward)
+		s.reverseDelays.addIPDV(next.reverse - delays.reverse)
+		s.rttDelays.addIPDV(next.rtt - delays.rtt)
+	}
+
+	// reordered packets are paired as long as they are not too late
+	s.recent[r.SenderSeqNum] = delays
+	s.recentOrder = append(s.recentOrder, r.SenderSeqNum)
+	if len(s.recentOrder) > reorderingHistory {
+		delete(s.recent, s.recentOrder[0])
+		s.recentOrder = s.recentOrder[1:]
+	}
+}
+
+/*
+Compute the delay variation of the forward and reverse delays and of the RTT. The
+clock offset of the reflector cancels out of the one-way delay variations.
+*/
+func (r *PingResults) UpdateDelayVariation() {
+	percentiles := r.Stat.getPercentiles()
+	r.Stat.ForwardVariation = r.Stat.forwardDelays.variation(percentiles)
+	r.Stat.ReverseVariation = r.Stat.reverseDelays.variation(percentiles)
+	r.Stat.RTTVariation = r.Stat.rttDelays.variation(percentiles)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDelayVariation(t *testing.T) {
+	ms := time.Millisecond
+	start := time.Unix(1700000000, 0)
+
+	// forward delays by Sender Sequence Number in arrival order, 2 is lost and
+	// 5 arrives before 4
+	sequences := []uint32{0, 1, 3, 5, 4}
+	forward := map[uint32]time.Duration{0: 10 * ms, 1: 12 * ms, 3: 11 * ms, 4: 15 * ms, 5: 13 * ms}
+
+	results := []*TwampResult{}
+	for _, sequence := range sequences {
+		sent := start.Add(time.Duration(sequence) * 100 * ms)
+		results = append(results, newTestResult(sequence, sent, forward[sequence], 0, 5*ms))
+	}
+
+	duplicate := *results[1]
+	duplicate.Duplicate = true
+	results = append(results, &duplicate)
+
+	v := countResults(results).Stat.ForwardVariation
+
+	// RFC 3393: IPDV of consecutive Sequence Numbers 0-1, 3-4 and 4-5 are 2, 4
+	// and -2 ms
+	if v.IPDV.Min != -2*ms || !near(v.IPDV.Mean, 4*ms/3, time.Microsecond) || v.IPDV.Max != 4*ms {
+		t.Errorf("IPDV %s, expected min/mean/max %s/%s/%s", v.IPDV, -2*ms, 4*ms/3, 4*ms)
+	}
+	if p := v.IPDV.Percentiles["p50"]; !near(p, 2*ms, 5*time.Microsecond) {
+		t.Errorf("IPDV p50 %s, expected 2 ms", p)
+	}
+
+	// RFC 5481: PDV is the delay above the minimum delay of 10 ms
+	if !near(v.PDV.Mean, 2200*time.Microsecond, time.Microsecond) || v.PDV.Max != 5*ms {
+		t.Errorf("PDV %s, expected mean/max 2.2/5 ms", v.PDV)
+	}
+	if p := v.PDV.Percentiles["p50"]; !near(p, 2*ms, 15*time.Microsecond) {
+		t.Errorf("PDV p50 %s, expected 2 ms", p)
+	}
+
+	// RFC 3550 jitter follows the arrival order: J += (|D| - J) / 16
+	jitter := 0.0
+	for i := 1; i < len(sequences); i++ {
+		difference := math.Abs(float64(forward[sequences[i]] - forward[sequences[i-1]]))
+		jitter += (difference - jitter) / 16
+	}
+	if !near(v.Jitter, time.Duration(jitter), time.Nanosecond) {
+		t.Errorf("jitter %s, expected %s", v.Jitter, time.Duration(jitter))
+	}
+
+	// the reverse delay does not vary
+	reverse := countResults(results).Stat.ReverseVariation
+	if reverse.IPDV.Max != 0 || reverse.PDV.Max != 0 || reverse.Jitter != 0 {
+		t.Errorf("reverse delay variation %+v, expected none", reverse)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -15,21 +16,124 @@ const (
 	ModeUnauthenticated = 1
 	ModeAuthenticated   = 2
 	ModeEncypted        = 4
+	ModeMixed           = 8 // encrypted TWAMP-Control, unauthenticated TWAMP-Test (RFC 5618)
 )
 
-type TwampFullClient struct{}
+/*
+Optional features requested with the mode bits, next to the security mode.
+*/
+const (
+	ModeIndividualSessionControl = 16  // Start-N-Sessions and Stop-N-Sessions (RFC 5938)
+	ModeReflectOctets            = 32  // Reflect Octets (RFC 6038)
+	ModeSymmetricalSize          = 64  // Symmetrical Size (RFC 6038)
+	ModeDscpEcn                  = 256 // DSCP and ECN monitoring (RFC 7750)
+)
+
+/*
+Bitmask of the optional features implemented by the client. They are requested
+whenever the server offers them.
+*/
+const supportedFeatures = ModeIndividualSessionControl | ModeReflectOctets | ModeSymmetricalSize | ModeDscpEcn
+
+/*
+Security modes ordered from the strongest to the weakest.
+*/
+var modeStrength = []uint32{ModeEncypted, ModeAuthenticated, ModeMixed, ModeUnauthenticated}
+
+/*
+Bitmask of all the security modes known by the client.
+*/
+const securityModes = ModeUnauthenticated | ModeAuthenticated | ModeEncypted | ModeMixed
+
+/*
+Get a human readable name of a security mode.
+*/
+func ModeName(mode uint32) string {
+	switch mode {
+	case ModeUnauthenticated:
+		return "unauthenticated"
+	case ModeAuthenticated:
+		return "authenticated"
+	case ModeEncypted:
+		return "encrypted"
+	case ModeMixed:
+		return "mixed"
+	}
+	return fmt.Sprintf("unknown (%d)", mode)
+}
+
+type TwampFullClient struct {
+	keyID     string
+	secret    []byte
+	allowed   uint32
+	preferred []uint32
+}
 
 func NewFullClient() *TwampFullClient {
-	return &TwampFullClient{}
+	return &TwampFullClient{allowed: securityModes}
+}
+
+/*
+Set the KeyID and the shared secret (passphrase) used when the TWAMP server
+requires authenticated, encrypted or mixed mode.
+*/
+func (c *TwampFullClient) SetSharedSecret(keyID string, secret []byte) {
+	c.keyID = keyID
+	c.secret = secret
+}
+
+/*
+Set the mode negotiation policy. Allowed is a bitmask of the security modes the
+client may select, preferred optionally lists modes in order of preference.
+Modes not listed in preferred are tried from the strongest to the weakest.
+*/
+func (c *TwampFullClient) SetModePolicy(allowed uint32, preferred ...uint32) {
+	c.allowed = allowed
+	c.preferred = preferred
+}
+
+/*
+Select the security mode to use from the modes offered in the Server Greeting.
+*/
+func (c *TwampFullClient) selectMode(offered uint32) (uint32, error) {
+	if offered&securityModes == 0 {
+		return ModeUnspecified, errors.New("The TWAMP server is not interested in communicating with you.")
+	}
+
+	// the feature bits of the Modes field are not security modes
+	candidates := offered & c.allowed & securityModes
+	if c.secret == nil {
+		// only unauthenticated mode works without a shared secret
+		candidates &= ModeUnauthenticated
+	}
+
+	for _, mode := range append(append([]uint32{}, c.preferred...), modeStrength...) {
+		if candidates&mode != 0 {
+			return mode, nil
+		}
+	}
+
+	if c.secret == nil && offered&c.allowed&securityModes != 0 {
+		return ModeUnspecified, errors.New("The TWAMP server requires authentication but no shared secret was set.")
+	}
+
+	return ModeUnspecified, errors.New(fmt.Sprintf("No common security mode: the TWAMP server offers %d, the client allows %d.", offered, c.allowed))
 }
 
 func (c *TwampFullClient) Connect(hostname string, port int) (*TwampFullConnection, error) {
 	// connect to remote host
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", hostname, port), time.Second*5)
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(hostname, strconv.Itoa(port)), time.Second*5)
 	if err != nil {
 		return nil, err
 	}
 
+	// the connection is closed when the setup fails
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
 	// create a new TwampFullConnection
 	twampConnection := NewTwampFullConnection(conn)
 
@@ -39,19 +143,26 @@ func (c *TwampFullClient) Connect(hostname string, port int) (*TwampFullConnecti
 		return nil, err
 	}
 
-	// check greeting mode for errors
-	switch greeting.Mode {
-	case ModeUnspecified:
-		return nil, errors.New("The TWAMP server is not interested in communicating with you.")
-	case ModeUnauthenticated:
-	case ModeAuthenticated:
-		return nil, errors.New("Authentication is not currently supported.")
-	case ModeEncypted:
-		return nil, errors.New("Encyption is not currently supported.")
+	// pick the mode to use from the ones offered by the server
+	mode, err := c.selectMode(greeting.Mode)
+	if err != nil {
+		return nil, err
 	}
 
 	// negotiate TWAMP session configuration
-	twampConnection.sendTwampClientSetupResponse()
+	response, err := twampConnection.newTwampClientSetupResponse(mode, greeting, c.keyID, c.secret)
+	if err != nil {
+		return nil, err
+	}
+
+	// request the optional features supported by both sides
+	twampConnection.features = greeting.Mode & supportedFeatures
+	response.Mode |= twampConnection.features
+
+	err = twampConnection.sendTwampClientSetupResponse(response)
+	if err != nil {
+		return nil, err
+	}
 
 	// check the start message from TWAMP server
 	serverStartMessage, err := twampConnection.getTwampServerStartMessage()
@@ -64,6 +175,12 @@ func (c *TwampFullClient) Connect(hostname string, port int) (*TwampFullConnecti
 		return nil, err
 	}
 
+	// from now on control messages are protected in authenticated, encrypted and mixed modes
+	err = twampConnection.startSecurity(response.ClientIV, serverStartMessage.ServerIV)
+	if err != nil {
+		return nil, err
+	}
+
 	return twampConnection, nil
 }
 
@@ -0,0 +1,25 @@
+package full
+
+import "testing"
+
+func TestSelectMode(t *testing.T) {
+	client := NewFullClient()
+	client.SetSharedSecret("key", []byte("secret"))
+
+	// feature bits offered by the server are never selected as the security mode
+	offered := uint32(ModeAuthenticated | ModeIndividualSessionControl | ModeReflectOctets)
+	client.SetModePolicy(0xffffffff, ModeIndividualSessionControl, ModeReflectOctets)
+	mode, err := client.selectMode(offered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != ModeAuthenticated {
+		t.Errorf("selected %s, expected %s", ModeName(mode), ModeName(ModeAuthenticated))
+	}
+
+	// only features in common is no common security mode
+	client.SetModePolicy(ModeEncypted | ModeIndividualSessionControl)
+	if mode, err := client.selectMode(offered); err == nil {
+		t.Errorf("selected %s without a common security mode", ModeName(mode))
+	}
+}
@@ -3,14 +3,24 @@ package full
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/halacs/twamp/common"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 type TwampFullConnection struct {
 	connection net.Conn
+	mode       uint32
+	features   uint32
+	security   *controlSecurity
+	mutex      sync.Mutex
+	sessions   []*TwampFullSession
 }
 
 func NewTwampFullConnection(conn net.Conn) *TwampFullConnection {
@@ -53,11 +63,142 @@ type TwampServerGreeting struct {
 	Count     uint32   // count (4 bytes)
 }
 
-func (c *TwampFullConnection) sendTwampClientSetupResponse() {
-	// negotiate TWAMP session configuration
+/*
+Build the Set-Up-Response for the selected mode. Unless the mode is
+unauthenticated, fresh session keys and Client-IV are generated and the Token is
+computed from the shared secret.
+*/
+func (c *TwampFullConnection) newTwampClientSetupResponse(mode uint32, greeting *TwampServerGreeting, keyID string, secret []byte) (*TwampClientSetUpResponse, error) {
 	response := &TwampClientSetUpResponse{}
-	response.Mode = ModeUnauthenticated
-	binary.Write(c.GetConnection(), binary.BigEndian, response)
+	response.Mode = mode
+	c.mode = mode
+
+	if mode == ModeUnauthenticated {
+		return response, nil
+	}
+
+	if len(keyID) > len(response.KeyID) {
+		return nil, errors.New(fmt.Sprintf("KeyID is too long: at most %d bytes are allowed.", len(response.KeyID)))
+	}
+
+	if greeting.Count < minimumCount {
+		return nil, errors.New(fmt.Sprintf("The TWAMP server announced a too small PBKDF2 count: %d.", greeting.Count))
+	}
+
+	aesKey := make([]byte, 16)
+	hmacKey := make([]byte, 32)
+	for _, buf := range [][]byte{aesKey, hmacKey, response.ClientIV[:]} {
+		err := randomBytes(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := newToken(secret, greeting, aesKey, hmacKey)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(response.KeyID[:], keyID)
+	response.Token = token
+
+	// keep the session keys until Server-Start delivers the Server-IV
+	c.security = &controlSecurity{aesKey: aesKey, hmacKey: hmacKey}
+
+	return response, nil
+}
+
+func (c *TwampFullConnection) sendTwampClientSetupResponse(response *TwampClientSetUpResponse) error {
+	// negotiate TWAMP session configuration
+	return binary.Write(c.GetConnection(), binary.BigEndian, response)
+}
+
+/*
+Turn on TWAMP-Control message protection once the Server-Start message has been
+received.
+*/
+func (c *TwampFullConnection) startSecurity(clientIV [16]byte, serverIV [16]byte) error {
+	if c.security == nil {
+		return nil
+	}
+
+	security, err := newControlSecurity(c.security.aesKey, c.security.hmacKey, clientIV, serverIV)
+	if err != nil {
+		return err
+	}
+
+	c.security = security
+	return nil
+}
+
+/*
+Get the security mode negotiated with the TWAMP server.
+*/
+func (c *TwampFullConnection) GetMode() uint32 {
+	return c.mode
+}
+
+/*
+Get the optional features (mode bits) negotiated with the TWAMP server.
+*/
+func (c *TwampFullConnection) GetFeatures() uint32 {
+	return c.features
+}
+
+/*
+Check whether Individual Session Control (RFC 5938) was negotiated.
+*/
+func (c *TwampFullConnection) hasIndividualSessionControl() bool {
+	return c.features&ModeIndividualSessionControl != 0
+}
+
+/*
+Send a TWAMP-Control message. The last block of the message is reserved for the
+HMAC which, together with encryption, is applied in place when the connection
+is protected.
+*/
+func (c *TwampFullConnection) writeMessage(pdu []byte) error {
+	if c.security != nil {
+		c.security.seal(pdu)
+	}
+
+	_, err := c.GetConnection().Write(pdu)
+	return err
+}
+
+/*
+Receive a TWAMP-Control message of the given size, decrypting it and verifying
+its HMAC when the connection is protected.
+*/
+func (c *TwampFullConnection) readMessage(size int) (bytes.Buffer, error) {
+	pdu := make([]byte, size)
+
+	_, err := io.ReadFull(c.GetConnection(), pdu)
+	if err != nil {
+		return bytes.Buffer{}, errors.New(fmt.Sprintf("readMessage: expected %d bytes: %v", size, err))
+	}
+
+	if c.security != nil {
+		err = c.security.open(pdu)
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+	}
+
+	return *bytes.NewBuffer(pdu), nil
+}
+
+/*
+Create the keys protecting the TWAMP-Test packets of the session identified by SID.
+In mixed mode only TWAMP-Control is protected, so the test packets keep the
+unauthenticated layout and can be timestamped by the reflector at line rate.
+*/
+func (c *TwampFullConnection) newTestSecurity(sid Sid) (*testSecurity, error) {
+	if c.security == nil || c.mode == ModeUnauthenticated || c.mode == ModeMixed {
+		return nil, nil
+	}
+
+	return newTestSecurity(c.mode, c.security, sid)
 }
 
 func (c *TwampFullConnection) getTwampServerGreetingMessage() (*TwampServerGreeting, error) {
@@ -103,16 +244,109 @@ func (c *TwampFullConnection) getTwampServerStartMessage() (*TwampServerStart, e
 	return start, nil
 }
 
+/*
+TWAMP-Control command numbers.
+*/
+const (
+	CommandStartSessions    = 2
+	CommandStopSessions     = 3
+	CommandRequestTwSession = 5
+	CommandStartNSessions   = 7
+	CommandStartNAck        = 8
+	CommandStopNSessions    = 9
+	CommandStopNAck         = 10
+)
+
+/*
+Size of the TWAMP-Control messages sent by the Control-Client, by command number.
+*/
+var commandSize = map[byte]int{
+	CommandStartSessions:    32,
+	CommandStopSessions:     32,
+	CommandRequestTwSession: 112,
+}
+
+/*
+Largest number of SIDs accepted in a Start-N-Sessions or Stop-N-Sessions command.
+*/
+const maxSessionsPerCommand = 1024
+
+/*
+Size of a Start-N-Sessions, Stop-N-Sessions or their Ack message listing the given
+number of sessions: a 16 byte header, the SIDs and the HMAC block.
+*/
+func individualSessionControlSize(number int) int {
+	return 16 + 16*number + hmacSize
+}
+
+/*
+Receive a TWAMP-Control command on the server side. The size of the message is
+only known once its first block, holding the command number, is decrypted.
+*/
+func (c *TwampFullConnection) readCommand() (bytes.Buffer, error) {
+	head := make([]byte, 16)
+
+	_, err := io.ReadFull(c.GetConnection(), head)
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+
+	if c.security != nil {
+		err = c.security.decrypt(head)
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+	}
+
+	size, ok := commandSize[head[0]]
+	if head[0] == CommandStartNSessions || head[0] == CommandStopNSessions {
+		number := binary.BigEndian.Uint32(head[4:])
+		if number == 0 || number > maxSessionsPerCommand {
+			return bytes.Buffer{}, errors.New(fmt.Sprintf("Invalid number of sessions in command %d: %d.", head[0], number))
+		}
+		size, ok = individualSessionControlSize(int(number)), true
+	}
+	if !ok {
+		return bytes.Buffer{}, errors.New(fmt.Sprintf("Unsupported TWAMP-Control command: %d.", head[0]))
+	}
+
+	pdu := make([]byte, size)
+	copy(pdu, head)
+
+	_, err = io.ReadFull(c.GetConnection(), pdu[len(head):])
+	if err != nil {
+		return bytes.Buffer{}, err
+	}
+
+	if c.security != nil {
+		err = c.security.decrypt(pdu[len(head):])
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+
+		err = c.security.verify(pdu)
+		if err != nil {
+			return bytes.Buffer{}, err
+		}
+	}
+
+	return *bytes.NewBuffer(pdu), nil
+}
+
 /* Byte offsets for Request-TW-Session TWAMP PDU */
 const ( // TODO these constants should be removed as part of a refactor when control changel messages are refactored to use "struct based" messaging which is clearer
 	offsetRequestTwampSessionCommand         = 0
 	offsetRequestTwampSessionIpVersion       = 1
 	offsetRequestTwampSessionSenderPort      = 12
 	offsetRequestTwampSessionReceiverPort    = 14
+	offsetRequestTwampSessionSenderAddress   = 16
+	offsetRequestTwampSessionReceiverAddress = 32
 	offsetRequestTwampSessionPaddingLength   = 64
 	offsetRequestTwampSessionStartTime       = 68
 	offsetRequestTwampSessionTimeout         = 76
 	offsetRequestTwampSessionTypePDescriptor = 84
+	offsetRequestTwampSessionReflectOctets   = 88 // RFC 6038
+	offsetRequestTwampSessionReflectPadding  = 90 // RFC 6038
 )
 
 type RequestTwSession []byte
@@ -126,21 +360,120 @@ func (b RequestTwSession) Encode(c common.TwampSessionConfig) {
 	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionPaddingLength:], uint32(c.Padding))
 	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionStartTime:], start_time.Integer)
 	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionStartTime+4:], start_time.Fraction)
-	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTimeout:], uint32(c.Timeout))
-	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTimeout+4:], 0)
-	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTypePDescriptor:], uint32(c.TOS))
+	timeout := c.GetTimeout()
+	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTimeout:], uint32(timeout/time.Second))
+	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTimeout+4:], uint32((uint64(timeout%time.Second)<<32)/uint64(time.Second)))
+	binary.BigEndian.PutUint32(b[offsetRequestTwampSessionTypePDescriptor:], uint32(c.TOS>>2)) // DSCP
+	binary.BigEndian.PutUint16(b[offsetRequestTwampSessionReflectOctets:], c.OctetsToReflect)
+	binary.BigEndian.PutUint16(b[offsetRequestTwampSessionReflectPadding:], uint16(c.PaddingToReflect))
 }
 
+/*
+Set the Session-Sender and Session-Reflector addresses and the matching IP
+version. IPv4 addresses take the first 4 bytes of the address fields, IPv6
+addresses all 16 bytes.
+*/
+func (b RequestTwSession) SetAddresses(sender net.IP, receiver net.IP) {
+	if sender.To4() != nil && receiver.To4() != nil {
+		b[offsetRequestTwampSessionIpVersion] = byte(4)
+		copy(b[offsetRequestTwampSessionSenderAddress:offsetRequestTwampSessionSenderAddress+4], sender.To4())
+		copy(b[offsetRequestTwampSessionReceiverAddress:offsetRequestTwampSessionReceiverAddress+4], receiver.To4())
+		return
+	}
+
+	b[offsetRequestTwampSessionIpVersion] = byte(6)
+	copy(b[offsetRequestTwampSessionSenderAddress:offsetRequestTwampSessionSenderAddress+16], sender.To16())
+	copy(b[offsetRequestTwampSessionReceiverAddress:offsetRequestTwampSessionReceiverAddress+16], receiver.To16())
+}
+
+/*
+Decode the test session parameters of a Request-TW-Session message received by the server.
+*/
+func (b RequestTwSession) Decode() common.TwampSessionConfig {
+	timeout := binary.BigEndian.Uint32(b[offsetRequestTwampSessionTimeout:])
+	timeoutFraction := binary.BigEndian.Uint32(b[offsetRequestTwampSessionTimeout+4:])
+
+	return common.TwampSessionConfig{
+		SenderPort:      int(binary.BigEndian.Uint16(b[offsetRequestTwampSessionSenderPort:])),
+		ReceiverPort:    int(binary.BigEndian.Uint16(b[offsetRequestTwampSessionReceiverPort:])),
+		Padding:         int(binary.BigEndian.Uint32(b[offsetRequestTwampSessionPaddingLength:])),
+		Timeout:         int(timeout),
+		TimeoutDuration: time.Duration(timeout)*time.Second + time.Duration((uint64(timeoutFraction)*uint64(time.Second))>>32),
+		TOS:             int(binary.BigEndian.Uint32(b[offsetRequestTwampSessionTypePDescriptor:])&0x3f) << 2,
+
+		OctetsToReflect:  binary.BigEndian.Uint16(b[offsetRequestTwampSessionReflectOctets:]),
+		PaddingToReflect: int(binary.BigEndian.Uint16(b[offsetRequestTwampSessionReflectPadding:])),
+	}
+}
+
+/*
+Get the IP version (4 or 6) requested for the test session.
+*/
+func (b RequestTwSession) GetIpVersion() int {
+	return int(b[offsetRequestTwampSessionIpVersion] & 0x0f)
+}
+
+/*
+Request a new test session. Several sessions, each with its own configuration,
+can be requested before they are started together. With Individual Session
+Control sessions can also be requested while others are running. The test
+socket is bound to the Sender Port of the configuration, or to a free port if
+it is not set, and that port is sent in Request-TW-Session.
+*/
 func (c *TwampFullConnection) CreateFullSession(config common.TwampSessionConfig) (*TwampFullSession, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Individual Session Control allows requesting sessions while others are running
+	if c.running() && !c.hasIndividualSessionControl() {
+		return nil, errors.New("Cannot request a session while test sessions are running.")
+	}
+
+	if (config.OctetsToReflect != 0 || config.PaddingToReflect != 0) && c.features&ModeReflectOctets == 0 {
+		return nil, errors.New("Reflect Octets was not negotiated with the TWAMP server.")
+	}
+
+	if config.PaddingToReflect > 0xffff {
+		return nil, errors.New(fmt.Sprintf("Length of padding to reflect too large: %d.", config.PaddingToReflect))
+	}
+
+	if config.SymmetricalSize {
+		if c.features&ModeSymmetricalSize == 0 {
+			return nil, errors.New("Symmetrical Size was not negotiated with the TWAMP server.")
+		}
+
+		// the sender packet must hold the reflector packet header and the reflected padding
+		minimum := c.symmetricalPadding() + config.PaddingToReflect
+		if config.Padding < minimum {
+			config.Padding = minimum
+		}
+	}
+
+	// bind the test socket before the request, so it carries the actual Sender Port
+	reserved, err := net.ListenUDP("udp", &net.UDPAddr{IP: c.LocalAddr().(*net.TCPAddr).IP, Port: config.SenderPort})
+	if err != nil {
+		return nil, err
+	}
+	config.SenderPort = reserved.LocalAddr().(*net.UDPAddr).Port
+
 	var pdu RequestTwSession = make(RequestTwSession, 112)
 
 	var session *TwampFullSession
+	defer func() {
+		if session == nil {
+			reserved.Close()
+		}
+	}()
 
 	pdu.Encode(config)
+	pdu.SetAddresses(c.LocalAddr().(*net.TCPAddr).IP, c.RemoteAddr().(*net.TCPAddr).IP)
 
-	c.GetConnection().Write(pdu)
+	err = c.writeMessage(pdu)
+	if err != nil {
+		return nil, err
+	}
 
-	acceptBuffer, err := common.ReadFromSocket(c.GetConnection(), 48)
+	acceptBuffer, err := c.readMessage(48)
 	if err != nil {
 		return nil, err
 	}
@@ -152,15 +485,300 @@ func (c *TwampFullConnection) CreateFullSession(config common.TwampSessionConfig
 		return nil, err
 	}
 
-	session = &TwampFullSession{connection: c, port: acceptSession.port, config: config}
+	if acceptSession.reflectedOctets != config.OctetsToReflect {
+		return nil, errors.New(fmt.Sprintf("The TWAMP server reflected octets %#04x instead of %#04x.", acceptSession.reflectedOctets, config.OctetsToReflect))
+	}
+
+	security, err := c.newTestSecurity(acceptSession.sid)
+	if err != nil {
+		return nil, err
+	}
+
+	session = &TwampFullSession{connection: c, port: acceptSession.port, sid: acceptSession.sid, config: config, security: security, reserved: reserved}
+	c.sessions = append(c.sessions, session)
 
 	return session, nil
 }
 
+/*
+Smallest padding making the Session-Sender packets as large as the
+Session-Reflector packet header in the security mode of the connection.
+*/
+func (c *TwampFullConnection) symmetricalPadding() int {
+	if c.mode == ModeAuthenticated || c.mode == ModeEncypted {
+		return binary.Size(common.AuthenticatedMeasurementPacket{}) - binary.Size(common.AuthenticatedTestPacket{})
+	}
+	return c.measurementHeaderSize() - binary.Size(common.TestPacket{})
+}
+
+/*
+Size of the unauthenticated Session-Reflector packet header. With DSCP and ECN
+monitoring (RFC 7750) the header is followed by the Sender DSCP and ECN octet.
+*/
+func (c *TwampFullConnection) measurementHeaderSize() int {
+	size := binary.Size(common.MeasurementPacket{})
+	if c.features&ModeDscpEcn != 0 {
+		size++
+	}
+	return size
+}
+
+/*
+Get the test sessions requested on the connection and not stopped yet.
+*/
+func (c *TwampFullConnection) GetSessions() []*TwampFullSession {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]*TwampFullSession{}, c.sessions...)
+}
+
+/*
+Check whether any test session of the connection is running.
+*/
+func (c *TwampFullConnection) running() bool {
+	for _, session := range c.sessions {
+		if session.running {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Start every requested test session with a single Start-Sessions command. Calling
+it again while the sessions are running has no effect. When Individual Session
+Control is negotiated and some sessions are already running, only the pending
+ones are started with Start-N-Sessions.
+*/
+func (c *TwampFullConnection) StartSessions() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending := []*TwampFullSession{}
+	for _, session := range c.sessions {
+		if !session.running {
+			pending = append(pending, session)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if c.running() {
+		return c.startNSessions(pending)
+	}
+
+	var pdu []byte = make([]byte, 32)
+	pdu[0] = CommandStartSessions
+
+	err := c.writeMessage(pdu)
+	if err != nil {
+		return err
+	}
+
+	startAckBuffer, err := c.readMessage(32)
+	if err != nil {
+		return err
+	}
+
+	accept, err := startAckBuffer.ReadByte()
+	if err != nil {
+		log.Printf("Cannot read: %s\n", err)
+		return err
+	}
+
+	err = checkAcceptStatus(int(accept), "test setup")
+	if err != nil {
+		return err
+	}
+
+	for _, session := range pending {
+		session.running = true
+	}
+	return nil
+}
+
+/*
+Stop every running test session with a single Stop-Sessions command. Calling it
+again once the sessions are stopped has no effect.
+*/
+func (c *TwampFullConnection) StopSessions() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.running() {
+		return nil
+	}
+
+	var pdu []byte = make([]byte, 32)
+	pdu[0] = CommandStopSessions                                 // Stop-Sessions Command Number
+	pdu[1] = byte(OK)                                            // Accept Status (0 = OK)
+	binary.BigEndian.PutUint32(pdu[4:], uint32(len(c.sessions))) // Number of Sessions
+
+	err := c.writeMessage(pdu)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range c.sessions {
+		session.running = false
+		session.release()
+	}
+	c.sessions = nil
+	return nil
+}
+
+/*
+Start the given test sessions with Start-N-Sessions (RFC 5938), leaving the other
+sessions of the connection untouched. Sessions already running are skipped.
+*/
+func (c *TwampFullConnection) StartNSessions(sessions ...*TwampFullSession) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	pending := []*TwampFullSession{}
+	for _, session := range sessions {
+		if !session.running {
+			pending = append(pending, session)
+		}
+	}
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return c.startNSessions(pending)
+}
+
+/*
+Stop the given test sessions with Stop-N-Sessions (RFC 5938), leaving the other
+sessions of the connection running. Stopped sessions are released by the server,
+request a new session to restart the measurement.
+*/
+func (c *TwampFullConnection) StopNSessions(sessions ...*TwampFullSession) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(sessions) == 0 {
+		return nil
+	}
+
+	err := c.individualSessionControl(CommandStopNSessions, sessions, "stopping sessions")
+	if err != nil {
+		return err
+	}
+
+	remaining := []*TwampFullSession{}
+	for _, session := range c.sessions {
+		stopped := false
+		for _, s := range sessions {
+			stopped = stopped || s == session
+		}
+		if stopped {
+			session.running = false
+			session.release()
+		} else {
+			remaining = append(remaining, session)
+		}
+	}
+	c.sessions = remaining
+
+	return nil
+}
+
+func (c *TwampFullConnection) startNSessions(sessions []*TwampFullSession) error {
+	err := c.individualSessionControl(CommandStartNSessions, sessions, "test setup")
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		session.running = true
+	}
+	return nil
+}
+
+/*
+Send a Start-N-Sessions or Stop-N-Sessions command listing the SIDs of the given
+sessions and check its Ack.
+*/
+func (c *TwampFullConnection) individualSessionControl(command byte, sessions []*TwampFullSession, context string) error {
+	if !c.hasIndividualSessionControl() {
+		return errors.New("Individual Session Control was not negotiated with the TWAMP server.")
+	}
+
+	if len(sessions) > maxSessionsPerCommand {
+		return errors.New(fmt.Sprintf("Too many sessions in one command: %d, at most %d.", len(sessions), maxSessionsPerCommand))
+	}
+
+	for _, session := range sessions {
+		if session.connection != c {
+			return errors.New(fmt.Sprintf("Session %s does not belong to this connection.", session.sid))
+		}
+	}
+
+	size := individualSessionControlSize(len(sessions))
+	pdu := make([]byte, size)
+	pdu[0] = command
+	binary.BigEndian.PutUint32(pdu[4:], uint32(len(sessions)))
+	for i, session := range sessions {
+		copy(pdu[16+16*i:], session.sid[:])
+	}
+
+	err := c.writeMessage(pdu)
+	if err != nil {
+		return err
+	}
+
+	ackBuffer, err := c.readMessage(size)
+	if err != nil {
+		return err
+	}
+
+	ack := ackBuffer.Bytes()
+	if ack[0] != command+1 {
+		return errors.New(fmt.Sprintf("Unexpected TWAMP-Control message %d, expected %d.", ack[0], command+1))
+	}
+
+	return checkAcceptStatus(int(ack[1]), context)
+}
+
+/*
+Start every requested test session and create their TWAMP tests.
+*/
+func (c *TwampFullConnection) CreateTests() ([]*TwampFullTest, error) {
+	tests := []*TwampFullTest{}
+	for _, session := range c.GetSessions() {
+		test, err := session.CreateTest()
+		if err != nil {
+			for _, test := range tests {
+				test.GetConnection().Close()
+			}
+			return nil, err
+		}
+		tests = append(tests, test)
+	}
+
+	return tests, nil
+}
+
+/*
+TWAMP Session Identifier (SID) assigned by the server in Accept-Session.
+*/
+type Sid [16]byte
+
+func (s Sid) String() string {
+	return hex.EncodeToString(s[:])
+}
+
 type TwampAcceptSession struct {
-	accept byte
-	port   uint16
-	sid    [16]byte
+	accept          byte
+	port            uint16
+	sid             Sid
+	reflectedOctets uint16
+	serverOctets    uint16
 }
 
 func NewTwampAcceptSession(buf bytes.Buffer) *TwampAcceptSession {
@@ -169,5 +787,47 @@ func NewTwampAcceptSession(buf bytes.Buffer) *TwampAcceptSession {
 	_ = buf.Next(1) // mbz
 	message.port = binary.BigEndian.Uint16(buf.Next(2))
 	copy(message.sid[:], buf.Next(16))
+	message.reflectedOctets = binary.BigEndian.Uint16(buf.Next(2))
+	message.serverOctets = binary.BigEndian.Uint16(buf.Next(2))
 	return message
 }
+
+func (m *TwampAcceptSession) GetAccept() byte {
+	return m.accept
+}
+
+func (m *TwampAcceptSession) GetPort() uint16 {
+	return m.port
+}
+
+func (m *TwampAcceptSession) GetSid() Sid {
+	return m.sid
+}
+
+/*
+Get the Octets to be reflected of Request-TW-Session, as returned by a server
+supporting Reflect Octets (RFC 6038).
+*/
+func (m *TwampAcceptSession) GetReflectedOctets() uint16 {
+	return m.reflectedOctets
+}
+
+/*
+Get the Server octets of a server supporting Reflect Octets (RFC 6038).
+*/
+func (m *TwampAcceptSession) GetServerOctets() uint16 {
+	return m.serverOctets
+}
+
+/*
+Encode the Accept-Session message sent by the server in reply to Request-TW-Session.
+*/
+func (m *TwampAcceptSession) Encode() []byte {
+	pdu := make([]byte, 48)
+	pdu[0] = m.accept
+	binary.BigEndian.PutUint16(pdu[2:], m.port)
+	copy(pdu[4:], m.sid[:])
+	binary.BigEndian.PutUint16(pdu[20:], m.reflectedOctets)
+	binary.BigEndian.PutUint16(pdu[22:], m.serverOctets)
+	return pdu
+}
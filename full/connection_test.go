@@ -0,0 +1,171 @@
+package full
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/halacs/twamp/common"
+)
+
+func TestIndividualSessionControl(t *testing.T) {
+	server := newTestServer(t)
+	client := NewFullClient()
+	client.SetSharedSecret("key", []byte("secret"))
+	conn := connectTestClient(t, server, client)
+
+	if conn.GetFeatures()&ModeIndividualSessionControl == 0 {
+		t.Fatalf("Individual Session Control not negotiated, features %#x", conn.GetFeatures())
+	}
+
+	a, err := conn.CreateFullSession(common.TwampSessionConfig{Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := conn.CreateFullSession(common.TwampSessionConfig{Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start-N-Sessions starts a alone
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.IsRunning() || b.IsRunning() {
+		t.Fatalf("running %v and %v after starting a, expected true and false", a.IsRunning(), b.IsRunning())
+	}
+	if _, err := a.CreateTest(); err != nil {
+		t.Fatal(err)
+	}
+	if b.IsRunning() {
+		t.Fatal("b started with the test of a")
+	}
+
+	testB, err := b.CreateTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stop-N-Sessions stops a alone
+	a.Stop()
+	if a.IsRunning() || !b.IsRunning() || len(conn.GetSessions()) != 1 {
+		t.Fatalf("running %v and %v with %d sessions after stopping a, expected false, true and 1",
+			a.IsRunning(), b.IsRunning(), len(conn.GetSessions()))
+	}
+
+	// sessions can be requested while others are running
+	_, testC := createTestSession(t, conn, common.TwampSessionConfig{Timeout: 1})
+	for _, results := range RunTests([]*TwampFullTest{testB, testC}, 10, nil, nil) {
+		if results.Stat.Received != 10 {
+			t.Errorf("%d of %d test packets reflected", results.Stat.Received, results.Stat.Transmitted)
+		}
+	}
+
+	if err := conn.StopSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.GetSessions()) != 0 {
+		t.Errorf("%d sessions after Stop-Sessions", len(conn.GetSessions()))
+	}
+}
+
+func TestReflectOctets(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+	}{
+		{"unauthenticated", ""},
+		{"authenticated", "secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			client := NewFullClient()
+			if test.secret != "" {
+				client.SetSharedSecret("key", []byte(test.secret))
+			}
+			conn := connectTestClient(t, server, client)
+
+			// the padding is increased to the size of the reflected packet
+			config := common.TwampSessionConfig{Timeout: 1, Padding: 5, OctetsToReflect: 0xabcd, PaddingToReflect: 5, SymmetricalSize: true}
+			session, twampTest := createTestSession(t, conn, config)
+			if session.GetConfig().Padding <= config.Padding {
+				t.Errorf("padding %d not increased for the symmetrical size", session.GetConfig().Padding)
+			}
+
+			// the client checks the reflected padding
+			r, err := twampTest.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.SenderSize != r.ReceiverSize {
+				t.Errorf("sent %d octets, reflected %d, expected the same size", r.SenderSize, r.ReceiverSize)
+			}
+			conn.StopSessions()
+
+			// the length of the padding to reflect is a 16-bit field
+			if _, err := conn.CreateFullSession(common.TwampSessionConfig{Timeout: 1, PaddingToReflect: 0x10000}); err == nil {
+				t.Error("session reflecting more than 65535 octets of padding accepted")
+			}
+		})
+	}
+}
+
+func TestRequestTwSessionTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		config common.TwampSessionConfig
+	}{
+		{"seconds", common.TwampSessionConfig{Timeout: 3}},
+		{"sub-second", common.TwampSessionConfig{TimeoutDuration: 1500 * time.Millisecond}},
+	}
+
+	for _, test := range tests {
+		pdu := make(RequestTwSession, 112)
+		pdu.Encode(test.config)
+		if timeout := pdu.Decode().GetTimeout(); timeout != test.config.GetTimeout() {
+			t.Errorf("%s: decoded Timeout %s, expected %s", test.name, timeout, test.config.GetTimeout())
+		}
+	}
+}
+
+func TestSenderPort(t *testing.T) {
+	server := newTestServer(t)
+	conn := connectTestClient(t, server, NewFullClient())
+
+	// without a Sender Port every session is sent from its own free port
+	a, testA := createTestSession(t, conn, common.TwampSessionConfig{Timeout: 1})
+	b, testB := createTestSession(t, conn, common.TwampSessionConfig{Timeout: 1})
+	for _, test := range []*TwampFullTest{testA, testB} {
+		port := test.GetConnection().LocalAddr().(*net.UDPAddr).Port
+		if port == 0 || port != test.GetSession().GetConfig().SenderPort {
+			t.Errorf("test sent from port %d, Sender Port %d requested", port, test.GetSession().GetConfig().SenderPort)
+		}
+	}
+	if a.GetConfig().SenderPort == b.GetConfig().SenderPort {
+		t.Errorf("both sessions requested Sender Port %d", a.GetConfig().SenderPort)
+	}
+	for _, results := range RunTests([]*TwampFullTest{testA, testB}, 5, nil, nil) {
+		if results.Stat.Received != 5 {
+			t.Errorf("%d of %d test packets reflected", results.Stat.Received, results.Stat.Transmitted)
+		}
+	}
+	conn.StopSessions()
+
+	// a configured Sender Port is used for the test
+	free, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderPort := free.LocalAddr().(*net.UDPAddr).Port
+	free.Close()
+
+	_, test := createTestSession(t, conn, common.TwampSessionConfig{Timeout: 1, SenderPort: senderPort})
+	if port := test.GetConnection().LocalAddr().(*net.UDPAddr).Port; port != senderPort {
+		t.Errorf("test sent from port %d, expected %d", port, senderPort)
+	}
+	if _, err := test.Run(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,242 @@
+package full
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/*
+Size of the unauthenticated Session-Sender packet header: Sequence Number,
+Timestamp and Error Estimate.
+*/
+const senderPacketSize = 14
+
+func errShortTestPacket(size int, expected int) error {
+	return errors.New(fmt.Sprintf("Test packet too short: expected at least %d bytes, got %d.", expected, size))
+}
+
+/*
+TWAMP Session-Reflector of one test session accepted by the TWAMP server.
+*/
+type sessionReflector struct {
+	sid        Sid
+	config     common.TwampSessionConfig
+	connection *net.UDPConn
+	security   *testSecurity
+	features   uint32
+	sequence   uint32
+	started    bool
+	stopOnce   sync.Once
+}
+
+func newSessionReflector(localIP net.IP, sid Sid, config common.TwampSessionConfig, security *testSecurity, features uint32) (*sessionReflector, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP, Port: config.ReceiverPort})
+	if err != nil {
+		// the requested port is not available, let the system choose one
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &sessionReflector{sid: sid, config: config, connection: conn, security: security, features: features}
+
+	// RFC recommends IP TTL of 255
+	err = common.SetPacketOptions(conn, 255, config.TOS)
+	if err != nil {
+		log.Printf("Cannot set TTL and TOS of the reflected packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTTL(conn)
+	if err != nil {
+		log.Printf("Cannot receive TTL of the test packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTimestamp(conn)
+	if err != nil {
+		log.Printf("Cannot receive kernel timestamps of the test packets: %v\n", err)
+	}
+
+	if features&ModeDscpEcn != 0 {
+		err = common.EnableReceiveTOS(conn)
+		if err != nil {
+			log.Printf("Cannot receive DSCP and ECN of the test packets: %v\n", err)
+		}
+	}
+
+	return r, nil
+}
+
+/*
+Get the UDP port the Session-Reflector is listening on.
+*/
+func (r *sessionReflector) GetPort() uint16 {
+	return uint16(r.connection.LocalAddr().(*net.UDPAddr).Port)
+}
+
+/*
+Start reflecting test packets.
+*/
+func (r *sessionReflector) start() {
+	if r.started {
+		return
+	}
+	r.started = true
+	go r.run()
+}
+
+/*
+Stop the session. Late test packets are still reflected during the session
+Timeout, as required by RFC 5357.
+*/
+func (r *sessionReflector) stop() {
+	r.stopOnce.Do(func() {
+		if !r.started {
+			r.connection.Close()
+			return
+		}
+		time.AfterFunc(r.config.GetTimeout(), func() {
+			r.connection.Close()
+		})
+	})
+}
+
+func (r *sessionReflector) run() {
+	buf := make([]byte, 65536)
+	for {
+		n, info, addr, err := common.ReadWithInfo(r.connection, buf)
+		if err != nil {
+			// socket closed when the session was stopped
+			return
+		}
+
+		err = r.reflect(buf[:n], info.Timestamp, info, addr)
+		if err != nil {
+			log.Printf("Session %s: cannot reflect test packet from %s: %v\n", r.sid, addr, err)
+		}
+	}
+}
+
+/*
+Build the Session-Reflector packet from a received Session-Sender packet and send
+it back. The reflected packet has the size of the received one, the padding is
+truncated by the difference of the header sizes. With Reflect Octets (RFC 6038)
+the packet is enlarged so the requested padding octets are returned in full.
+With DSCP and ECN monitoring (RFC 7750) the received TOS is reported after the
+Sender TTL.
+*/
+func (r *sessionReflector) reflect(pdu []byte, received time.Time, info common.PacketInfo, addr net.Addr) error {
+	ttl := byte(0)
+	if info.TTL > 0 {
+		ttl = byte(info.TTL)
+	}
+
+	dscpEcn := byte(0)
+	if info.TOS >= 0 && r.features&ModeDscpEcn != 0 {
+		dscpEcn = byte(info.TOS)
+	}
+
+	senderSize := senderPacketSize
+	format := r.config.TimestampFormat
+	var replyHeader interface{}
+
+	if r.security != nil {
+		senderHeader := common.AuthenticatedTestPacket{}
+		senderSize = binary.Size(senderHeader)
+		if len(pdu) < senderSize {
+			return errShortTestPacket(len(pdu), senderSize)
+		}
+
+		err := r.security.open(pdu, senderSize-hmacSize)
+		if err != nil {
+			return err
+		}
+
+		err = binary.Read(bytes.NewReader(pdu), binary.BigEndian, &senderHeader)
+		if err != nil {
+			return err
+		}
+
+		replyHeader = common.AuthenticatedMeasurementPacket{
+			Sequence:            r.sequence,
+			Timestamp:           *common.NewTwampTimestampFormat(time.Now(), format),
+			ErrorEstimate:       common.GetErrorEstimate(format),
+			ReceiveTimeStamp:    *common.NewTwampTimestampFormat(received, format),
+			SenderSequence:      senderHeader.Sequence,
+			SenderTimeStamp:     senderHeader.Timestamp,
+			SenderErrorEstimate: senderHeader.ErrorEstimate,
+			SenderTtl:           ttl,
+			SenderDscpEcn:       dscpEcn,
+		}
+	} else {
+		if len(pdu) < senderSize {
+			return errShortTestPacket(len(pdu), senderSize)
+		}
+
+		replyHeader = common.MeasurementPacket{
+			Sequence:         r.sequence,
+			Timestamp:        *common.NewTwampTimestampFormat(time.Now(), format),
+			ErrorEstimate:    common.GetErrorEstimate(format),
+			ReceiveTimeStamp: *common.NewTwampTimestampFormat(received, format),
+			SenderSequence:   binary.BigEndian.Uint32(pdu[0:]),
+			SenderTimeStamp: common.TwampTimestamp{
+				Integer:  binary.BigEndian.Uint32(pdu[4:]),
+				Fraction: binary.BigEndian.Uint32(pdu[8:]),
+			},
+			SenderErrorEstimate: binary.BigEndian.Uint16(pdu[12:]),
+			SenderTtl:           ttl,
+		}
+	}
+
+	headerSize := binary.Size(replyHeader)
+	if r.security == nil && r.features&ModeDscpEcn != 0 {
+		// Sender DSCP and ECN octet following the unauthenticated header
+		headerSize++
+	}
+
+	totalSize := len(pdu)
+	if totalSize < headerSize {
+		totalSize = headerSize
+	}
+
+	reflected := len(pdu) - senderSize
+	if reflected > r.config.PaddingToReflect {
+		reflected = r.config.PaddingToReflect
+	}
+	if totalSize < headerSize+reflected {
+		totalSize = headerSize + reflected
+	}
+
+	reply := make([]byte, totalSize)
+	copy(reply[headerSize:], pdu[senderSize:])
+
+	var binaryBuffer bytes.Buffer
+	err := binary.Write(&binaryBuffer, binary.BigEndian, replyHeader)
+	if err != nil {
+		return err
+	}
+	copy(reply, binaryBuffer.Bytes())
+
+	if r.security == nil && r.features&ModeDscpEcn != 0 {
+		reply[headerSize-1] = dscpEcn
+	}
+
+	if r.security != nil {
+		r.security.seal(reply, headerSize-hmacSize)
+	}
+
+	_, err = r.connection.WriteTo(reply, addr)
+	if err != nil {
+		return err
+	}
+
+	r.sequence++
+	return nil
+}
@@ -0,0 +1,242 @@
+package full
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+/*
+Size of the truncated HMAC-SHA1 carried in TWAMP-Control and TWAMP-Test messages.
+*/
+const hmacSize = 16
+
+/*
+Minimum PBKDF2 iteration count a server may announce in its greeting (RFC 4656).
+*/
+const minimumCount = 1024
+
+/*
+Derive the shared secret key from the passphrase using PBKDF2 with the Salt and
+Count announced in the Server Greeting (RFC 4656 section 3.1).
+*/
+func deriveKey(secret []byte, salt [16]byte, count uint32) []byte {
+	return pbkdf2.Key(secret, salt[:], int(count), aes.BlockSize, sha1.New)
+}
+
+/*
+Build the Set-Up-Response Token: the server Challenge followed by the AES and
+HMAC session keys, encrypted in CBC mode (IV=0) with the key derived from the
+shared secret.
+*/
+func newToken(secret []byte, greeting *TwampServerGreeting, aesKey []byte, hmacKey []byte) ([64]byte, error) {
+	var token [64]byte
+
+	block, err := aes.NewCipher(deriveKey(secret, greeting.Salt, greeting.Count))
+	if err != nil {
+		return token, err
+	}
+
+	copy(token[0:], greeting.Challenge[:])
+	copy(token[16:], aesKey)
+	copy(token[32:], hmacKey)
+
+	var iv [aes.BlockSize]byte
+	cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(token[:], token[:])
+
+	return token, nil
+}
+
+/*
+Decrypt a Set-Up-Response Token and check that it carries the Challenge sent in
+the Server Greeting. The AES and HMAC session keys are returned.
+*/
+func openToken(secret []byte, greeting *TwampServerGreeting, token [64]byte) ([]byte, []byte, error) {
+	block, err := aes.NewCipher(deriveKey(secret, greeting.Salt, greeting.Count))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var iv [aes.BlockSize]byte
+	cipher.NewCBCDecrypter(block, iv[:]).CryptBlocks(token[:], token[:])
+
+	if !hmac.Equal(token[0:16], greeting.Challenge[:]) {
+		return nil, nil, errors.New("Token verification failed: challenge mismatch.")
+	}
+
+	aesKey := make([]byte, 16)
+	hmacKey := make([]byte, 32)
+	copy(aesKey, token[16:32])
+	copy(hmacKey, token[32:64])
+
+	return aesKey, hmacKey, nil
+}
+
+/*
+Fill the buffer with cryptographically secure random bytes.
+*/
+func randomBytes(buf []byte) error {
+	_, err := rand.Read(buf)
+	return err
+}
+
+/*
+Compute the truncated HMAC-SHA1 of the data.
+*/
+func computeHMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:hmacSize]
+}
+
+/*
+Cryptographic state of a TWAMP-Control connection after Server-Start. Every
+message is terminated by an HMAC block and the whole message is encrypted with
+the AES session key in CBC mode. The CBC chain is continued across messages,
+starting from the Client-IV in the client-to-server direction and from the
+Server-IV in the opposite one.
+*/
+type controlSecurity struct {
+	aesKey    []byte
+	hmacKey   []byte
+	encrypter cipher.BlockMode
+	decrypter cipher.BlockMode
+}
+
+func newControlSecurity(aesKey []byte, hmacKey []byte, sendIV [16]byte, receiveIV [16]byte) (*controlSecurity, error) {
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &controlSecurity{
+		aesKey:    aesKey,
+		hmacKey:   hmacKey,
+		encrypter: cipher.NewCBCEncrypter(block, sendIV[:]),
+		decrypter: cipher.NewCBCDecrypter(block, receiveIV[:]),
+	}, nil
+}
+
+/*
+Write the HMAC of the message into its last block and encrypt it in place.
+*/
+func (s *controlSecurity) seal(pdu []byte) {
+	covered := len(pdu) - hmacSize
+	copy(pdu[covered:], computeHMAC(s.hmacKey, pdu[:covered]))
+	s.encrypter.CryptBlocks(pdu, pdu)
+}
+
+/*
+Decrypt the message in place and verify the HMAC found in its last block.
+*/
+func (s *controlSecurity) open(pdu []byte) error {
+	err := s.decrypt(pdu)
+	if err != nil {
+		return err
+	}
+
+	return s.verify(pdu)
+}
+
+/*
+Decrypt a part of the incoming message stream in place. Messages may be
+decrypted block by block as the CBC chain is kept between calls.
+*/
+func (s *controlSecurity) decrypt(pdu []byte) error {
+	if len(pdu)%aes.BlockSize != 0 {
+		return errors.New(fmt.Sprintf("Control message size %d is not a multiple of the AES block size.", len(pdu)))
+	}
+
+	s.decrypter.CryptBlocks(pdu, pdu)
+	return nil
+}
+
+/*
+Verify the HMAC found in the last block of a decrypted message.
+*/
+func (s *controlSecurity) verify(pdu []byte) error {
+	covered := len(pdu) - hmacSize
+	if covered < 0 || !hmac.Equal(pdu[covered:], computeHMAC(s.hmacKey, pdu[:covered])) {
+		return errors.New("Control message HMAC verification failed.")
+	}
+
+	return nil
+}
+
+/*
+Keys protecting the TWAMP-Test packets of one session. The test AES key is the
+SID encrypted with the control AES session key in ECB mode, the test HMAC key is
+the control HMAC session key encrypted in CBC mode (IV=0) with the test AES key.
+*/
+type testSecurity struct {
+	mode    uint32
+	block   cipher.Block
+	hmacKey []byte
+}
+
+func newTestSecurity(mode uint32, control *controlSecurity, sid Sid) (*testSecurity, error) {
+	controlBlock, err := aes.NewCipher(control.aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	testKey := make([]byte, aes.BlockSize)
+	controlBlock.Encrypt(testKey, sid[:])
+
+	block, err := aes.NewCipher(testKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hmacKey := make([]byte, len(control.hmacKey))
+	var iv [aes.BlockSize]byte
+	cipher.NewCBCEncrypter(block, iv[:]).CryptBlocks(hmacKey, control.hmacKey)
+
+	return &testSecurity{mode: mode, block: block, hmacKey: hmacKey}, nil
+}
+
+/*
+Protect a test packet in place. The HMAC of the first covered octets is written
+right after them. In authenticated mode only the Sequence Number block is then
+encrypted in ECB mode, in encrypted mode all covered octets are encrypted in
+CBC mode (IV=0).
+*/
+func (s *testSecurity) seal(pdu []byte, covered int) {
+	copy(pdu[covered:], computeHMAC(s.hmacKey, pdu[:covered]))
+
+	switch s.mode {
+	case ModeEncypted:
+		var iv [aes.BlockSize]byte
+		cipher.NewCBCEncrypter(s.block, iv[:]).CryptBlocks(pdu[:covered], pdu[:covered])
+	default:
+		s.block.Encrypt(pdu[:aes.BlockSize], pdu[:aes.BlockSize])
+	}
+}
+
+/*
+Decrypt a protected test packet in place and verify its HMAC.
+*/
+func (s *testSecurity) open(pdu []byte, covered int) error {
+	if len(pdu) < covered+hmacSize {
+		return errors.New(fmt.Sprintf("Test packet too short: expected at least %d bytes, got %d.", covered+hmacSize, len(pdu)))
+	}
+
+	switch s.mode {
+	case ModeEncypted:
+		var iv [aes.BlockSize]byte
+		cipher.NewCBCDecrypter(s.block, iv[:]).CryptBlocks(pdu[:covered], pdu[:covered])
+	default:
+		s.block.Decrypt(pdu[:aes.BlockSize], pdu[:aes.BlockSize])
+	}
+
+	if !hmac.Equal(pdu[covered:covered+hmacSize], computeHMAC(s.hmacKey, pdu[:covered])) {
+		return errors.New("Test packet HMAC verification failed.")
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package full
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func testGreeting() *TwampServerGreeting {
+	greeting := &TwampServerGreeting{Mode: ModeAuthenticated, Count: minimumCount}
+	for i := range greeting.Challenge {
+		greeting.Challenge[i] = byte(i)
+		greeting.Salt[i] = byte(0xf0 + i)
+	}
+	return greeting
+}
+
+func sequentialBytes(size int, first byte) []byte {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = first + byte(i)
+	}
+	return buf
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+	greeting := testGreeting()
+	aesKey := sequentialBytes(16, 0x10)
+	hmacKey := sequentialBytes(32, 0x40)
+
+	token, err := newToken(secret, greeting, aesKey, hmacKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 4656 section 3.1: Challenge, AES and HMAC session keys encrypted in
+	// CBC mode with IV=0 and the key derived from the shared secret
+	block, err := aes.NewCipher(deriveKey(secret, greeting.Salt, greeting.Count))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := make([]byte, len(token))
+	var iv [aes.BlockSize]byte
+	cipher.NewCBCDecrypter(block, iv[:]).CryptBlocks(plain, token[:])
+
+	expected := append(append(append([]byte{}, greeting.Challenge[:]...), aesKey...), hmacKey...)
+	if !bytes.Equal(plain, expected) {
+		t.Errorf("token plaintext = %x, expected %x", plain, expected)
+	}
+
+	openedAES, openedHMAC, err := openToken(secret, greeting, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(openedAES, aesKey) || !bytes.Equal(openedHMAC, hmacKey) {
+		t.Errorf("opened keys %x %x, expected %x %x", openedAES, openedHMAC, aesKey, hmacKey)
+	}
+}
+
+func TestOpenTokenFailures(t *testing.T) {
+	greeting := testGreeting()
+	token, err := newToken([]byte("secret"), greeting, sequentialBytes(16, 0x10), sequentialBytes(32, 0x40))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherSalt := testGreeting()
+	otherSalt.Salt[0]++
+	otherChallenge := testGreeting()
+	otherChallenge.Challenge[15]++
+
+	tests := []struct {
+		name     string
+		secret   string
+		greeting *TwampServerGreeting
+	}{
+		{"wrong secret", "other", greeting},
+		{"wrong salt", "secret", otherSalt},
+		{"wrong challenge", "secret", otherChallenge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := openToken([]byte(test.secret), test.greeting, token)
+			if err == nil {
+				t.Error("token opened, expected an error")
+			}
+		})
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	greeting := testGreeting()
+	key := deriveKey([]byte("secret"), greeting.Salt, greeting.Count)
+	if len(key) != aes.BlockSize {
+		t.Fatalf("key size %d, expected %d", len(key), aes.BlockSize)
+	}
+	if !bytes.Equal(key, deriveKey([]byte("secret"), greeting.Salt, greeting.Count)) {
+		t.Error("key derivation is not deterministic")
+	}
+	if bytes.Equal(key, deriveKey([]byte("secret"), greeting.Salt, greeting.Count+1)) {
+		t.Error("key does not depend on the count")
+	}
+}
+
+/*
+Security states of both ends of a TWAMP-Control connection.
+*/
+func testControlSecurity(t *testing.T) (*controlSecurity, *controlSecurity) {
+	aesKey := sequentialBytes(16, 0x10)
+	hmacKey := sequentialBytes(32, 0x40)
+	var clientIV, serverIV [16]byte
+	copy(clientIV[:], sequentialBytes(16, 0x80))
+	copy(serverIV[:], sequentialBytes(16, 0xa0))
+
+	client, err := newControlSecurity(aesKey, hmacKey, clientIV, serverIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newControlSecurity(aesKey, hmacKey, serverIV, clientIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestControlSealOpen(t *testing.T) {
+	client, server := testControlSecurity(t)
+
+	// Request-TW-Session, Start-Sessions and Stop-Sessions sizes with their HMAC
+	for _, size := range []int{112, 32, 32} {
+		message := sequentialBytes(size, byte(size))
+		copy(message[size-hmacSize:], make([]byte, hmacSize))
+		pdu := append([]byte{}, message...)
+
+		client.seal(pdu)
+		if bytes.Equal(pdu[:size-hmacSize], message[:size-hmacSize]) {
+			t.Errorf("message of %d bytes not encrypted", size)
+		}
+
+		err := server.open(pdu)
+		if err != nil {
+			t.Fatalf("message of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(pdu[:size-hmacSize], message[:size-hmacSize]) {
+			t.Errorf("opened message %x, expected %x", pdu[:size-hmacSize], message[:size-hmacSize])
+		}
+		if !bytes.Equal(pdu[size-hmacSize:], computeHMAC(client.hmacKey, message[:size-hmacSize])) {
+			t.Errorf("HMAC block %x does not cover the message", pdu[size-hmacSize:])
+		}
+	}
+}
+
+func TestControlOpenFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(pdu []byte) []byte
+	}{
+		{"tampered", func(pdu []byte) []byte { pdu[0] ^= 1; return pdu }},
+		{"tampered HMAC", func(pdu []byte) []byte { pdu[len(pdu)-1] ^= 1; return pdu }},
+		{"partial block", func(pdu []byte) []byte { return pdu[:len(pdu)-1] }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := testControlSecurity(t)
+			pdu := sequentialBytes(32, 0)
+			client.seal(pdu)
+
+			err := server.open(test.tamper(pdu))
+			if err == nil {
+				t.Error("message opened, expected an error")
+			}
+		})
+	}
+}
+
+func TestTestSealOpen(t *testing.T) {
+	control, _ := testControlSecurity(t)
+	var sid [16]byte
+	copy(sid[:], sequentialBytes(16, 0xc0))
+
+	// Session-Sender packet in authenticated and encrypted modes (RFC 5357
+	// section 4.1.2): the HMAC covers the first 32 octets
+	const covered = 32
+	tests := []struct {
+		name      string
+		mode      uint32
+		encrypted int // octets encrypted
+	}{
+		{"authenticated", ModeAuthenticated, aes.BlockSize},
+		{"encrypted", ModeEncypted, covered},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			security, err := newTestSecurity(test.mode, control, sid)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			packet := sequentialBytes(covered+hmacSize+8, 1)
+			pdu := append([]byte{}, packet...)
+			security.seal(pdu, covered)
+
+			if bytes.Equal(pdu[:aes.BlockSize], packet[:aes.BlockSize]) {
+				t.Error("first block not encrypted")
+			}
+			if !bytes.Equal(pdu[test.encrypted:covered], packet[test.encrypted:covered]) {
+				t.Error("octets after the encrypted ones changed")
+			}
+			if !bytes.Equal(pdu[covered+hmacSize:], packet[covered+hmacSize:]) {
+				t.Error("padding changed")
+			}
+
+			err = security.open(pdu, covered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pdu[:covered], packet[:covered]) {
+				t.Errorf("opened packet %x, expected %x", pdu[:covered], packet[:covered])
+			}
+
+			pdu[covered] ^= 1
+			if security.open(pdu, covered) == nil {
+				t.Error("packet with a tampered HMAC opened")
+			}
+			if security.open(pdu[:covered], covered) == nil {
+				t.Error("short packet opened")
+			}
+		})
+	}
+}
+
+func TestTestSecurityKeys(t *testing.T) {
+	control, _ := testControlSecurity(t)
+	var sid, other [16]byte
+	other[0] = 1
+
+	first, err := newTestSecurity(ModeAuthenticated, control, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newTestSecurity(ModeAuthenticated, control, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(first.hmacKey, second.hmacKey) {
+		t.Error("sessions of different SIDs share the test HMAC key")
+	}
+	if len(first.hmacKey) != len(control.hmacKey) {
+		t.Errorf("test HMAC key size %d, expected %d", len(first.hmacKey), len(control.hmacKey))
+	}
+}
@@ -0,0 +1,477 @@
+package full
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+TWAMP server implementing the Server and Session-Reflector roles: it accepts
+TWAMP-Control connections and reflects the TWAMP-Test packets of the sessions
+requested on them.
+*/
+type TwampFullServer struct {
+	modes       uint32
+	modesSet    bool // the modes were set by SetModes
+	secrets     map[string][]byte
+	listener    net.Listener
+	mutex       sync.Mutex
+	connections map[net.Conn]bool
+	format      common.TimestampFormat
+}
+
+func NewFullServer() *TwampFullServer {
+	return &TwampFullServer{
+		modes:       ModeUnauthenticated | supportedFeatures,
+		secrets:     map[string][]byte{},
+		connections: map[net.Conn]bool{},
+	}
+}
+
+/*
+Add a KeyID and its shared secret (passphrase). Once a shared secret is known the
+server offers authenticated, encrypted and mixed modes as well, unless the modes
+were set by SetModes.
+*/
+func (s *TwampFullServer) AddSharedSecret(keyID string, secret []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.secrets[keyID] = secret
+	if !s.modesSet {
+		s.modes |= ModeAuthenticated | ModeEncypted | ModeMixed
+	}
+}
+
+/*
+Set the security modes and optional features (bitmask) offered in the Server
+Greeting. Shared secrets added afterwards do not change them.
+*/
+func (s *TwampFullServer) SetModes(modes uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.modes = modes
+	s.modesSet = true
+}
+
+/*
+Get the security modes and optional features offered in the Server Greeting.
+*/
+func (s *TwampFullServer) GetModes() uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.modes
+}
+
+/*
+Get the shared secret of a KeyID.
+*/
+func (s *TwampFullServer) getSharedSecret(keyID string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	secret, ok := s.secrets[keyID]
+	return secret, ok
+}
+
+/*
+Set the format of the timestamps of the reflected test packets, NTP by default.
+*/
+func (s *TwampFullServer) SetTimestampFormat(format common.TimestampFormat) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.format = format
+}
+
+func (s *TwampFullServer) getTimestampFormat() common.TimestampFormat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.format
+}
+
+/*
+Listen for TWAMP-Control connections on the given address. The well-known TWAMP
+port is 862.
+*/
+func (s *TwampFullServer) Listen(hostname string, port int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(hostname, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+	return nil
+}
+
+/*
+Get the address the server is listening on.
+*/
+func (s *TwampFullServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+/*
+Serve TWAMP-Control connections until the server is closed.
+*/
+func (s *TwampFullServer) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConnection(conn)
+	}
+}
+
+/*
+Stop listening and close all the TWAMP-Control connections.
+*/
+func (s *TwampFullServer) Close() {
+	s.listener.Close()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for conn := range s.connections {
+		conn.Close()
+	}
+}
+
+func (s *TwampFullServer) track(conn net.Conn, active bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if active {
+		s.connections[conn] = true
+	} else {
+		delete(s.connections, conn)
+	}
+}
+
+/*
+Server side state of one TWAMP-Control connection.
+*/
+type controlSession struct {
+	connection *TwampFullConnection
+	localIP    net.IP
+	format     common.TimestampFormat
+	reflectors map[Sid]*sessionReflector
+}
+
+func (s *TwampFullServer) serveConnection(conn net.Conn) {
+	s.track(conn, true)
+	defer s.track(conn, false)
+	defer conn.Close()
+
+	c := NewTwampFullConnection(conn)
+	err := s.handshake(c)
+	if err != nil {
+		log.Printf("TWAMP-Control connection from %s rejected: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	session := &controlSession{
+		connection: c,
+		localIP:    conn.LocalAddr().(*net.TCPAddr).IP,
+		format:     s.getTimestampFormat(),
+		reflectors: map[Sid]*sessionReflector{},
+	}
+	defer session.stopSessions()
+
+	for {
+		buffer, err := c.readCommand()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("TWAMP-Control connection from %s closed: %v\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		pdu := buffer.Bytes()
+		switch pdu[0] {
+		case CommandRequestTwSession:
+			err = session.acceptSession(RequestTwSession(pdu))
+		case CommandStartSessions:
+			err = session.startSessions()
+		case CommandStopSessions:
+			number := binary.BigEndian.Uint32(pdu[4:])
+			if int(number) != len(session.reflectors) {
+				log.Printf("Stop-Sessions from %s for %d sessions, %d are running.\n", conn.RemoteAddr(), number, len(session.reflectors))
+			}
+			session.stopSessions()
+		case CommandStartNSessions, CommandStopNSessions:
+			err = session.individualSessionControl(pdu)
+		}
+
+		if err != nil {
+			log.Printf("TWAMP-Control connection from %s closed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+/*
+Perform the connection setup: send the Server Greeting, check the Set-Up-Response
+and reply with Server-Start.
+*/
+func (s *TwampFullServer) handshake(c *TwampFullConnection) error {
+	modes := s.GetModes()
+	greeting := &TwampServerGreeting{Mode: modes, Count: minimumCount}
+	for _, buf := range [][]byte{greeting.Challenge[:], greeting.Salt[:]} {
+		err := randomBytes(buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.sendTwampServerGreetingMessage(greeting)
+	if err != nil {
+		return err
+	}
+
+	response, err := c.getTwampClientSetupResponse()
+	if err != nil {
+		return err
+	}
+
+	if response.Mode == ModeUnspecified {
+		return errors.New("The client is not interested in communicating with us.")
+	}
+
+	start := &TwampServerStart{StartTime: *common.NewTwampTimestamp(time.Now())}
+
+	mode := response.Mode & securityModes
+	features := response.Mode &^ securityModes
+	if mode&modes == 0 || mode&(mode-1) != 0 || features&^(modes&supportedFeatures) != 0 {
+		start.Accept = NotSupported
+		c.sendTwampServerStartMessage(start)
+		return errors.New(fmt.Sprintf("Unsupported mode requested: %d.", response.Mode))
+	}
+
+	var aesKey, hmacKey []byte
+	if mode != ModeUnauthenticated {
+		keyID := string(bytes.TrimRight(response.KeyID[:], "\x00"))
+		secret, ok := s.getSharedSecret(keyID)
+		if !ok {
+			start.Accept = Failed
+			c.sendTwampServerStartMessage(start)
+			return errors.New(fmt.Sprintf("Unknown KeyID: %s.", keyID))
+		}
+
+		aesKey, hmacKey, err = openToken(secret, greeting, response.Token)
+		if err != nil {
+			start.Accept = Failed
+			c.sendTwampServerStartMessage(start)
+			return err
+		}
+
+		err = randomBytes(start.ServerIV[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.sendTwampServerStartMessage(start)
+	if err != nil {
+		return err
+	}
+
+	c.mode = mode
+	c.features = features
+	if mode != ModeUnauthenticated {
+		c.security, err = newControlSecurity(aesKey, hmacKey, start.ServerIV, response.ClientIV)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+Create a Session-Reflector for a Request-TW-Session and reply with Accept-Session.
+*/
+func (s *controlSession) acceptSession(request RequestTwSession) error {
+	accept := &TwampAcceptSession{accept: OK}
+
+	// test packets are reflected on the address family of the control connection
+	ipVersion := 6
+	if s.localIP.To4() != nil {
+		ipVersion = 4
+	}
+
+	if request.GetIpVersion() != ipVersion {
+		accept.accept = NotSupported
+		return s.connection.writeMessage(accept.Encode())
+	}
+
+	accept.sid = newSid(s.localIP)
+
+	config := request.Decode()
+	config.TimestampFormat = s.format
+	if s.connection.features&ModeReflectOctets != 0 {
+		accept.reflectedOctets = config.OctetsToReflect
+	} else {
+		config.OctetsToReflect = 0
+		config.PaddingToReflect = 0
+	}
+
+	security, err := s.connection.newTestSecurity(accept.sid)
+	if err != nil {
+		return err
+	}
+
+	reflector, err := newSessionReflector(s.localIP, accept.sid, config, security, s.connection.features)
+	if err != nil {
+		log.Printf("Cannot create Session-Reflector: %v\n", err)
+		accept.accept = TemporaryResourceLimitation
+		return s.connection.writeMessage(accept.Encode())
+	}
+
+	accept.port = reflector.GetPort()
+	s.reflectors[accept.sid] = reflector
+	log.Printf("Session %s accepted from %s, reflecting on port %d.\n", accept.sid, s.connection.RemoteAddr(), accept.port)
+
+	return s.connection.writeMessage(accept.Encode())
+}
+
+/*
+Acknowledge Start-Sessions and start every requested Session-Reflector.
+*/
+func (s *controlSession) startSessions() error {
+	pdu := make([]byte, 32)
+	pdu[0] = OK
+
+	err := s.connection.writeMessage(pdu)
+	if err != nil {
+		return err
+	}
+
+	for _, reflector := range s.reflectors {
+		reflector.start()
+	}
+
+	return nil
+}
+
+/*
+Start or stop the Session-Reflectors listed in a Start-N-Sessions or
+Stop-N-Sessions command and reply with the Ack. Nothing is done unless every
+SID belongs to the connection.
+*/
+func (s *controlSession) individualSessionControl(pdu []byte) error {
+	number := int(binary.BigEndian.Uint32(pdu[4:]))
+
+	ack := make([]byte, len(pdu))
+	ack[0] = pdu[0] + 1
+	binary.BigEndian.PutUint32(ack[4:], uint32(number))
+	copy(ack[16:], pdu[16:16+16*number])
+
+	if !s.connection.hasIndividualSessionControl() {
+		ack[1] = NotSupported
+		return s.connection.writeMessage(ack)
+	}
+
+	reflectors := []*sessionReflector{}
+	for i := 0; i < number; i++ {
+		var sid Sid
+		copy(sid[:], pdu[16+16*i:])
+
+		reflector, ok := s.reflectors[sid]
+		if !ok {
+			log.Printf("Command %d from %s for unknown session %s.\n", pdu[0], s.connection.RemoteAddr(), sid)
+			ack[1] = Failed
+			return s.connection.writeMessage(ack)
+		}
+		reflectors = append(reflectors, reflector)
+	}
+
+	err := s.connection.writeMessage(ack)
+	if err != nil {
+		return err
+	}
+
+	for _, reflector := range reflectors {
+		if pdu[0] == CommandStartNSessions {
+			reflector.start()
+		} else {
+			reflector.stop()
+			delete(s.reflectors, reflector.sid)
+		}
+	}
+
+	return nil
+}
+
+/*
+Stop every Session-Reflector of the connection.
+*/
+func (s *controlSession) stopSessions() {
+	for sid, reflector := range s.reflectors {
+		reflector.stop()
+		delete(s.reflectors, sid)
+	}
+}
+
+/*
+Generate a Session Identifier: the receiver IPv4 address, a timestamp and a
+random number (RFC 4656 section 3.5). The last 4 bytes of IPv6 addresses are used.
+*/
+func newSid(ip net.IP) Sid {
+	var sid Sid
+
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(sid[0:4], ip4)
+	} else if len(ip) == net.IPv6len {
+		copy(sid[0:4], ip[12:16])
+	}
+
+	timestamp := common.NewTwampTimestamp(time.Now())
+	binary.BigEndian.PutUint32(sid[4:], timestamp.Integer)
+	binary.BigEndian.PutUint32(sid[8:], timestamp.Fraction)
+	randomBytes(sid[12:])
+
+	return sid
+}
+
+func (c *TwampFullConnection) sendTwampServerGreetingMessage(greeting *TwampServerGreeting) error {
+	pdu := make([]byte, 64)
+	binary.BigEndian.PutUint32(pdu[12:], greeting.Mode)
+	copy(pdu[16:], greeting.Challenge[:])
+	copy(pdu[32:], greeting.Salt[:])
+	binary.BigEndian.PutUint32(pdu[48:], greeting.Count)
+
+	_, err := c.GetConnection().Write(pdu)
+	return err
+}
+
+func (c *TwampFullConnection) getTwampClientSetupResponse() (*TwampClientSetUpResponse, error) {
+	response := &TwampClientSetUpResponse{}
+	err := binary.Read(c.GetConnection(), binary.BigEndian, response)
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (c *TwampFullConnection) sendTwampServerStartMessage(start *TwampServerStart) error {
+	pdu := make([]byte, 48)
+	pdu[15] = start.Accept
+	copy(pdu[16:], start.ServerIV[:])
+	binary.BigEndian.PutUint32(pdu[32:], start.StartTime.Integer)
+	binary.BigEndian.PutUint32(pdu[36:], start.StartTime.Fraction)
+
+	_, err := c.GetConnection().Write(pdu)
+	return err
+}
@@ -0,0 +1,118 @@
+package full
+
+import (
+	"net"
+	"testing"
+
+	"github.com/halacs/twamp/common"
+)
+
+/*
+Start a TWAMP server on the loopback interface, which knows the shared secret
+"secret" of the key ID "key".
+*/
+func newTestServer(t *testing.T) *TwampFullServer {
+	server := NewFullServer()
+	server.AddSharedSecret("key", []byte("secret"))
+	if err := server.Listen("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(server.Close)
+	return server
+}
+
+/*
+Connect the client to the test server.
+*/
+func connectTestClient(t *testing.T, server *TwampFullServer, client *TwampFullClient) *TwampFullConnection {
+	conn, err := client.Connect("127.0.0.1", server.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+/*
+Create a test of a new session on the connection.
+*/
+func createTestSession(t *testing.T, conn *TwampFullConnection, config common.TwampSessionConfig) (*TwampFullSession, *TwampFullTest) {
+	session, err := conn.CreateFullSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test, err := session.CreateTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session, test
+}
+
+func TestServerModes(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		mode   uint32
+	}{
+		{"unauthenticated", "", ModeUnauthenticated},
+		{"authenticated", "secret", ModeAuthenticated},
+		{"encrypted", "secret", ModeEncypted},
+		{"mixed", "secret", ModeMixed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			client := NewFullClient()
+			if test.secret != "" {
+				client.SetSharedSecret("key", []byte(test.secret))
+			}
+			client.SetModePolicy(test.mode)
+
+			conn := connectTestClient(t, server, client)
+			if mode := conn.GetMode(); mode != test.mode {
+				t.Fatalf("negotiated %s, expected %s", ModeName(mode), ModeName(test.mode))
+			}
+
+			session, twampTest := createTestSession(t, conn, common.TwampSessionConfig{Padding: 20, Timeout: 1})
+			results := twampTest.RunX(5, nil, nil)
+			if results.Stat.Received != 5 {
+				t.Errorf("%d of %d test packets reflected", results.Stat.Received, results.Stat.Transmitted)
+			}
+			session.Stop()
+		})
+	}
+}
+
+func TestServerRejectsClient(t *testing.T) {
+	tests := []struct {
+		name        string
+		keyID       string
+		secret      string
+		serverModes uint32
+	}{
+		{"wrong secret", "key", "wrong", 0},
+		{"unknown key ID", "other", "secret", 0},
+		{"no common mode", "key", "secret", ModeUnauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(t)
+			if test.serverModes != 0 {
+				server.SetModes(test.serverModes)
+			}
+
+			client := NewFullClient()
+			client.SetSharedSecret(test.keyID, []byte(test.secret))
+			client.SetModePolicy(ModeAuthenticated)
+
+			conn, err := client.Connect("127.0.0.1", server.Addr().(*net.TCPAddr).Port)
+			if err == nil {
+				conn.Close()
+				t.Fatal("connected, expected an error")
+			}
+		})
+	}
+}
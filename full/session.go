@@ -1,17 +1,20 @@
 package full
 
 import (
-	"encoding/binary"
-	"fmt"
 	"github.com/halacs/twamp/common"
-	"log"
 	"net"
+	"strconv"
 )
 
 type TwampFullSession struct {
 	connection *TwampFullConnection
 	port       uint16
+	sid        Sid
 	config     common.TwampSessionConfig
+	security   *testSecurity
+	running    bool
+	// UDP socket holding the Sender Port until the test is created
+	reserved *net.UDPConn
 }
 
 func (s *TwampFullSession) GetConnection() net.Conn {
@@ -26,30 +29,37 @@ func (s *TwampFullSession) GetPort() uint16 {
 	return s.port
 }
 
-func (s *TwampFullSession) Write(buf []byte) {
-	s.GetConnection().Write(buf)
+/*
+Get the Session Identifier (SID) assigned by the server.
+*/
+func (s *TwampFullSession) GetSid() Sid {
+	return s.sid
 }
 
-func (s *TwampFullSession) CreateTest() (*TwampFullTest, error) {
-	var pdu []byte = make([]byte, 32)
-	pdu[0] = 2
-
-	s.Write(pdu)
-
-	startAckBuffer, err := common.ReadFromSocket(s.GetConnection(), 32)
-	if err != nil {
-		return nil, err
-	}
+/*
+Check whether the test session was started and not stopped yet.
+*/
+func (s *TwampFullSession) IsRunning() bool {
+	s.connection.mutex.Lock()
+	defer s.connection.mutex.Unlock()
+	return s.running
+}
 
-	accept, err := startAckBuffer.ReadByte()
-	if err != nil {
-		log.Printf("Cannot read: %s\n", err)
-		return nil, err
-	}
+func (s *TwampFullSession) Write(buf []byte) {
+	s.connection.writeMessage(buf)
+}
 
-	err = checkAcceptStatus(int(accept), "test setup")
-	if err != nil {
-		return nil, err
+/*
+Create the TWAMP test of the session. The first test created on a connection
+sends Start-Sessions, which starts every session requested on it. A session
+already started with Start is not started again.
+*/
+func (s *TwampFullSession) CreateTest() (*TwampFullTest, error) {
+	if !s.IsRunning() {
+		err := s.connection.StartSessions()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	test := &TwampFullTest{Session: s}
@@ -57,12 +67,17 @@ func (s *TwampFullSession) CreateTest() (*TwampFullTest, error) {
 	if err != nil {
 		return nil, err
 	}
-	localAddress := fmt.Sprintf("%s:%d", test.GetLocalTestHost(), s.GetConfig().ReceiverPort)
+	localAddress := net.JoinHostPort(test.GetLocalTestHost(), strconv.Itoa(s.GetConfig().SenderPort))
 	localAddr, err := net.ResolveUDPAddr("udp", localAddress)
 	if err != nil {
 		return nil, err
 	}
 
+	// the Sender Port requested for the session is released for the test socket
+	s.connection.mutex.Lock()
+	s.release()
+	s.connection.mutex.Unlock()
+
 	conn, err := net.DialUDP("udp", localAddr, remoteAddr)
 	if err != nil {
 		return nil, err
@@ -73,11 +88,34 @@ func (s *TwampFullSession) CreateTest() (*TwampFullTest, error) {
 	return test, nil
 }
 
+/*
+Release the UDP socket holding the Sender Port of the session. The connection
+mutex must be held.
+*/
+func (s *TwampFullSession) release() {
+	if s.reserved != nil {
+		s.reserved.Close()
+		s.reserved = nil
+	}
+}
+
+/*
+Start this test session alone with Start-N-Sessions. It requires Individual
+Session Control (RFC 5938) to be negotiated with the server.
+*/
+func (s *TwampFullSession) Start() error {
+	return s.connection.StartNSessions(s)
+}
+
+/*
+Stop the test session. With Individual Session Control (RFC 5938) only this
+session is stopped, otherwise Stop-Sessions stops every session of the control
+connection, see TwampFullConnection.StopSessions.
+*/
 func (s *TwampFullSession) Stop() {
-	//	log.Println("Stopping test sessions.")
-	var pdu []byte = make([]byte, 32)
-	pdu[0] = byte(3)                       // Stop-Sessions Command Number
-	pdu[1] = byte(0)                       // Accept Status (0 = OK)
-	binary.BigEndian.PutUint16(pdu[4:], 1) // Number of Sessions
-	s.GetConnection().Write(pdu)
+	if s.connection.hasIndividualSessionControl() {
+		s.connection.StopNSessions(s)
+		return
+	}
+	s.connection.StopSessions()
 }
@@ -7,13 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/halacs/twamp/common"
-	"golang.org/x/net/ipv4"
 	"log"
 	"math/rand"
 	"net"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
-	"unsafe"
 )
 
 /*
@@ -23,24 +22,38 @@ type TwampFullTest struct {
 	Session    *TwampFullSession
 	Connection *net.UDPConn
 	Sequence   uint32
+	engine     *common.Engine
 }
 
 /*
  */
 func (t *TwampFullTest) SetConnection(connection *net.UDPConn) {
-	c := ipv4.NewConn(connection)
-
 	// RFC recommends IP TTL of 255
-	err := c.SetTTL(255)
+	err := common.SetPacketOptions(connection, 255, t.GetSession().GetConfig().TOS)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = c.SetTOS(t.GetSession().GetConfig().TOS)
-	if err != nil {
-		log.Fatal(err)
+	if t.GetSession().connection.GetFeatures()&ModeDscpEcn != 0 {
+		err = common.EnableReceiveTOS(connection)
+		if err != nil {
+			log.Printf("Cannot receive DSCP and ECN of the reflected packets: %v\n", err)
+		}
+	}
+
+	if t.GetSession().GetConfig().KernelTimestamps {
+		err = common.EnableReceiveTimestamp(connection)
+		if err != nil {
+			log.Printf("Cannot receive kernel timestamps of the reflected packets: %v\n", err)
+		}
 	}
 
+	config := t.GetSession().GetConfig()
+	t.engine = common.NewEngine(connection, t, config.Interval, config.GetLossThreshold())
+	t.engine.KeepResults = config.KeepResults
+	t.engine.Percentiles = config.Percentiles
+	t.engine.HistogramBounds = config.HistogramBounds
+	t.engine.LogPrefix = fmt.Sprintf("SID %s: ", t.GetSession().GetSid())
 	t.Connection = connection
 }
 
@@ -62,7 +75,7 @@ func (t *TwampFullTest) GetSession() *TwampFullSession {
 Get the remote TWAMP IP/UDP address.
 */
 func (t *TwampFullTest) RemoteAddr() (*net.UDPAddr, error) {
-	address := fmt.Sprintf("%s:%d", t.GetRemoteTestHost(), t.GetRemoteTestPort())
+	address := net.JoinHostPort(t.GetRemoteTestHost(), strconv.Itoa(int(t.GetRemoteTestPort())))
 	return net.ResolveUDPAddr("udp", address)
 }
 
@@ -78,7 +91,8 @@ Get the local IP address for the TWAMP control Session.
 */
 func (t *TwampFullTest) GetLocalTestHost() string {
 	localAddress := t.Session.GetConnection().LocalAddr()
-	return strings.Split(localAddress.String(), ":")[0]
+	host, _, _ := net.SplitHostPort(localAddress.String())
+	return host
 }
 
 /*
@@ -86,77 +100,202 @@ Get the remote IP address for the TWAMP control Session.
 */
 func (t *TwampFullTest) GetRemoteTestHost() string {
 	remoteAddress := t.Session.GetConnection().RemoteAddr()
-	return strings.Split(remoteAddress.String(), ":")[0]
+	host, _, _ := net.SplitHostPort(remoteAddress.String())
+	return host
 }
 
 /*
 Run a TWAMP test and return a pointer to the TwampResult.
 */
 func (t *TwampFullTest) Run() (*common.TwampResult, error) {
-	paddingSize := t.GetSession().config.Padding
-	senderSeqNum := t.Sequence
+	t.engine.Sequence = t.Sequence
+	r, err := t.engine.RunOne()
+	t.Sequence = t.engine.Sequence
+	return r, err
+}
 
-	size := t.sendTestMessage(t.GetSession().config.UseAllZeros)
+/*
+Decode a Session-Reflector packet into a TwampResult.
+*/
+func (t *TwampFullTest) DecodeReflectedPacket(pdu []byte, info common.PacketInfo) (*common.TwampResult, error) {
+	if len(pdu) < t.measurementPacketSize() {
+		return nil, errors.New(fmt.Sprintf("Reflected packet too short: expected at least %d bytes, got %d.", t.measurementPacketSize(), len(pdu)))
+	}
 
-	// receive test packets - allocate a receive buffer of a size we expect to receive plus a bit to know if we get some garbage
-	buffer, err := common.ReadFromSocket(t.GetConnection(), (int(unsafe.Sizeof(common.MeasurementPacket{}))+paddingSize)*2)
+	buffer := bytes.NewBuffer(pdu)
+	responseHeader, forwardTOS, err := t.decodeMeasurementPacket(buffer)
 	if err != nil {
 		return nil, err
 	}
 
-	finished := time.Now()
+	// process test results
+	r := &common.TwampResult{}
+	r.ReceiverSize = len(pdu)
+	r.SeqNum = responseHeader.Sequence
+	reflectorFormat := common.TimestampFormatOf(responseHeader.ErrorEstimate)
+	r.Timestamp = common.NewTimestampFormat(responseHeader.Timestamp, reflectorFormat)
+	r.ReceiveTimestamp = common.NewTimestampFormat(responseHeader.ReceiveTimeStamp, reflectorFormat)
+	r.SenderSeqNum = responseHeader.SenderSequence
+	r.SenderTimestamp = common.NewTimestampFormat(responseHeader.SenderTimeStamp, common.TimestampFormatOf(responseHeader.SenderErrorEstimate))
+	r.SetErrorEstimates(responseHeader.ErrorEstimate, responseHeader.SenderErrorEstimate)
+	r.SenderTTL = responseHeader.SenderTtl
+	r.FinishedTimestamp = info.Timestamp
+	r.SetTOS(t.GetSession().config.TOS, forwardTOS, info.TOS)
+
+	return r, nil
+}
 
-	responseHeader := common.MeasurementPacket{}
-	err = binary.Read(&buffer, binary.BigEndian, &responseHeader)
+/*
+Check a Session-Reflector packet against the Session-Sender packet it reflects:
+the reflected padding (Reflect Octets) and the packet size (Symmetrical Size).
+*/
+func (t *TwampFullTest) CheckReflectedPacket(r *common.TwampResult, pdu []byte, sent []byte) error {
+	padding := sent[len(sent)-t.GetSession().config.Padding:]
+	err := t.checkReflectedPadding(pdu[t.measurementPacketSize():], padding)
 	if err != nil {
-		log.Fatalf("Failed to deserialize measurement package. %v", err)
+		return err
 	}
 
-	responsePadding := make([]byte, paddingSize, paddingSize)
-	receivedPaddignSize, err := buffer.Read(responsePadding)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error when receivin padding. %v\n", err))
+	if t.GetSession().config.SymmetricalSize && len(pdu) != len(sent) {
+		return errors.New(fmt.Sprintf("Asymmetrical reflected packet: sent %d bytes but received %d.", len(sent), len(pdu)))
+	}
+
+	return nil
+}
+
+/*
+Get the number of reflected packets received after the loss threshold of their
+test packet. Their test packets are counted as lost.
+*/
+func (t *TwampFullTest) GetLate() int {
+	return t.engine.GetLate()
+}
+
+/*
+Get the number of duplicated reflected packets.
+*/
+func (t *TwampFullTest) GetDuplicates() int {
+	return t.engine.GetDuplicates()
+}
+
+/*
+Check that the padding octets the session asked the reflector to return (Reflect
+Octets, RFC 6038) arrived unchanged.
+*/
+func (t *TwampFullTest) checkReflectedPadding(reflected []byte, padding []byte) error {
+	size := t.GetSession().config.PaddingToReflect
+	if size > len(padding) {
+		size = len(padding)
 	}
 
-	if receivedPaddignSize != paddingSize {
-		return nil, errors.New(fmt.Sprintf("Incorrect padding. Expected padding size was %d but received %d.\n", paddingSize, receivedPaddignSize))
+	if len(reflected) < size {
+		return errors.New(fmt.Sprintf("Reflected padding too short: expected %d bytes, got %d.", size, len(reflected)))
 	}
 
-	// process test results
-	r := &common.TwampResult{}
-	r.SenderSize = size
-	r.SeqNum = responseHeader.Sequence
-	r.Timestamp = common.NewTimestamp(responseHeader.Timestamp)
-	r.ErrorEstimate = responseHeader.ErrorEstimate
-	r.ReceiveTimestamp = common.NewTimestamp(responseHeader.ReceiveTimeStamp)
-	r.SenderSeqNum = responseHeader.SenderSequence
-	r.SenderTimestamp = common.NewTimestamp(responseHeader.SenderTimeStamp)
-	r.SenderErrorEstimate = responseHeader.SenderErrorEstimate
-	r.SenderTTL = responseHeader.SenderTtl
-	r.FinishedTimestamp = finished
+	if !bytes.Equal(reflected[:size], padding[:size]) {
+		return errors.New("Reflected padding does not match the padding sent.")
+	}
 
-	if senderSeqNum != r.SenderSeqNum {
-		return nil, errors.New(
-			fmt.Sprintf("Expected Sequence # %d but received %d.\n", senderSeqNum, r.SeqNum),
-		)
+	return nil
+}
+
+/*
+Size of the Session-Reflector packet header expected for the session security mode.
+*/
+func (t *TwampFullTest) measurementPacketSize() int {
+	if t.GetSession().security != nil {
+		return binary.Size(common.AuthenticatedMeasurementPacket{})
 	}
+	return t.GetSession().connection.measurementHeaderSize()
+}
 
-	return r, nil
+/*
+Decode the Session-Reflector packet header. In authenticated and encrypted modes
+the header is decrypted and its HMAC verified first. The TOS received by the
+reflector is also returned, -1 unless DSCP and ECN monitoring is negotiated.
+*/
+func (t *TwampFullTest) decodeMeasurementPacket(buffer *bytes.Buffer) (*common.MeasurementPacket, int, error) {
+	responseHeader := &common.MeasurementPacket{}
+
+	forwardTOS := -1
+	dscpEcn := t.GetSession().connection.GetFeatures()&ModeDscpEcn != 0
+
+	security := t.GetSession().security
+	if security == nil {
+		err := binary.Read(buffer, binary.BigEndian, responseHeader)
+		if err != nil {
+			return nil, forwardTOS, err
+		}
+
+		if dscpEcn {
+			tos, err := buffer.ReadByte()
+			if err != nil {
+				return nil, forwardTOS, err
+			}
+			forwardTOS = int(tos)
+		}
+		return responseHeader, forwardTOS, nil
+	}
+
+	authHeader := common.AuthenticatedMeasurementPacket{}
+	headerSize := binary.Size(authHeader)
+	pdu := buffer.Next(headerSize)
+	err := security.open(pdu, headerSize-hmacSize)
+	if err != nil {
+		return nil, forwardTOS, err
+	}
+
+	err = binary.Read(bytes.NewReader(pdu), binary.BigEndian, &authHeader)
+	if err != nil {
+		return nil, forwardTOS, err
+	}
+
+	if dscpEcn {
+		forwardTOS = int(authHeader.SenderDscpEcn)
+	}
+
+	responseHeader.Sequence = authHeader.Sequence
+	responseHeader.Timestamp = authHeader.Timestamp
+	responseHeader.ErrorEstimate = authHeader.ErrorEstimate
+	responseHeader.ReceiveTimeStamp = authHeader.ReceiveTimeStamp
+	responseHeader.SenderSequence = authHeader.SenderSequence
+	responseHeader.SenderTimeStamp = authHeader.SenderTimeStamp
+	responseHeader.SenderErrorEstimate = authHeader.SenderErrorEstimate
+	responseHeader.SenderTtl = authHeader.SenderTtl
+
+	return responseHeader, forwardTOS, nil
 }
 
-func (t *TwampFullTest) sendTestMessage(useAllZeros bool) int {
-	packetHeader := common.MeasurementPacket{
-		Sequence:            t.Sequence,
-		Timestamp:           *common.NewTwampTimestamp(time.Now()),
-		ErrorEstimate:       0x0101,
-		MBZ:                 0x0000,
-		ReceiveTimeStamp:    common.TwampTimestamp{},
-		SenderSequence:      0,
-		SenderTimeStamp:     common.TwampTimestamp{},
-		SenderErrorEstimate: 0x0000,
-		Mbz:                 0x0000,
-		SenderTtl:           87,
+/*
+Build the Session-Sender packet header matching the session security mode.
+Unauthenticated and mixed mode sessions share the unauthenticated layout.
+*/
+func (t *TwampFullTest) newTestPacketHeader(sequence uint32) interface{} {
+	format := t.GetSession().config.TimestampFormat
+	errorEstimate := common.GetErrorEstimate(format)
+	timestamp := *common.NewTwampTimestampFormat(time.Now(), format)
+
+	if t.GetSession().security != nil {
+		return common.AuthenticatedTestPacket{
+			Sequence:      sequence,
+			Timestamp:     timestamp,
+			ErrorEstimate: errorEstimate,
+		}
+	}
+
+	return common.TestPacket{
+		Sequence:      sequence,
+		Timestamp:     timestamp,
+		ErrorEstimate: errorEstimate,
 	}
+}
+
+/*
+Build the Session-Sender packet of the given Sequence Number.
+*/
+func (t *TwampFullTest) NewTestPacket(sequence uint32) ([]byte, error) {
+	packetHeader := t.newTestPacketHeader(sequence)
+	useAllZeros := t.GetSession().config.UseAllZeros
 
 	// seed psuedo-random number generator if requested
 	if !useAllZeros {
@@ -177,19 +316,23 @@ func (t *TwampFullTest) sendTestMessage(useAllZeros bool) int {
 	var binaryBuffer bytes.Buffer
 	err := binary.Write(&binaryBuffer, binary.BigEndian, packetHeader)
 	if err != nil {
-		log.Fatalf("Failed to serialize measurement package. %v", err)
+		return nil, err
 	}
 
 	headerBytes := binaryBuffer.Bytes()
 	headerSize := binaryBuffer.Len()
+
+	security := t.GetSession().security
+	if security != nil {
+		security.seal(headerBytes, headerSize-hmacSize)
+	}
+
 	totalSize := headerSize + paddingSize
 	var pdu []byte = make([]byte, totalSize)
 	copy(pdu[0:], headerBytes)
 	copy(pdu[headerSize:], padding)
 
-	t.GetConnection().Write(pdu)
-	t.Sequence++
-	return totalSize
+	return pdu, nil
 }
 
 func (t *TwampFullTest) FormatJSON(r *common.PingResults) {
@@ -209,13 +352,17 @@ func (t *TwampFullTest) ReturnJSON(r *common.PingResults) string {
 }
 
 func (t *TwampFullTest) Ping(count int, isRapid bool, interval int) *common.PingResults {
-	Stats := &common.PingResultStats{}
-	Results := &common.PingResults{Stat: Stats}
-	var TotalRTT time.Duration = 0
+	config := t.GetSession().GetConfig()
+	Stats := common.NewPingResultStats(config.Percentiles, config.HistogramBounds)
+	Results := &common.PingResults{
+		Stat: Stats,
+		Mode: ModeName(t.GetSession().connection.GetMode()),
+		Sid:  t.GetSession().GetSid().String(),
+	}
 
-	packetSize := 14 + t.GetSession().GetConfig().Padding
+	packetSize := 14 + config.Padding
 
-	fmt.Printf("TWAMP PING %s: %d data bytes\n", t.GetRemoteTestHost(), packetSize)
+	fmt.Printf("TWAMP PING %s: %d data bytes, SID %s\n", t.GetRemoteTestHost(), packetSize, t.GetSession().GetSid())
 
 	for i := 0; i < count; i++ {
 		Stats.Transmitted++
@@ -223,22 +370,12 @@ func (t *TwampFullTest) Ping(count int, isRapid bool, interval int) *common.Ping
 		if err != nil {
 			if isRapid {
 				fmt.Printf(".")
+			} else if common.IsLost(err) {
+				fmt.Printf("Request timeout for twamp_seq=%d\n", t.Sequence-1)
 			}
 		} else {
-			if i == 0 {
-				Stats.Min = results.GetRTT()
-				Stats.Max = results.GetRTT()
-			}
-			if Stats.Min > results.GetRTT() {
-				Stats.Min = results.GetRTT()
-			}
-			if Stats.Max < results.GetRTT() {
-				Stats.Max = results.GetRTT()
-			}
-
-			TotalRTT += results.GetRTT()
-			Stats.Received++
-			Results.Results = append(Results.Results, results)
+			Stats.Count(results)
+			Results.AddResult(results, config.KeepResults)
 
 			if isRapid {
 				fmt.Printf("!")
@@ -262,93 +399,71 @@ func (t *TwampFullTest) Ping(count int, isRapid bool, interval int) *common.Ping
 		fmt.Printf("\n")
 	}
 
-	Stats.Avg = time.Duration(int64(TotalRTT) / int64(count))
 	Stats.Loss = float64(float64(Stats.Transmitted-Stats.Received)/float64(Stats.Transmitted)) * 100.0
-	Stats.StdDev = Results.StdDev(Stats.Avg)
+	Results.UpdateStats()
+	Stats.Late = t.GetLate()
+	t.engine.CountLateReordering(Stats)
+	Stats.SetDuplicates(t.GetDuplicates())
 
 	fmt.Printf("--- %s twamp ping statistics ---\n", t.GetRemoteTestHost())
-	fmt.Printf("%d packets transmitted, %d packets received, %0.1f%% packet loss\n",
-		Stats.Transmitted,
-		Stats.Received,
-		Stats.Loss)
-	fmt.Printf("round-trip min/avg/max/stddev = %0.3f/%0.3f/%0.3f/%0.3f ms\n",
-		(float64(Stats.Min) / float64(time.Millisecond)),
-		(float64(Stats.Avg) / float64(time.Millisecond)),
-		(float64(Stats.Max) / float64(time.Millisecond)),
-		(float64(Stats.StdDev) / float64(time.Millisecond)),
-	)
+	Results.PrintStats(t.GetSession().config.GetLossThreshold())
 	defer t.Connection.Close()
 
 	return Results
 }
 
-func (t *TwampFullTest) updateStats(doStdDev bool, TotalRTT time.Duration, count int, stats *common.PingResultStats, Results *common.PingResults) {
-	stats.Avg = time.Duration(int64(TotalRTT) / int64(count))
-	stats.Loss = float64(float64(stats.Transmitted-stats.Received)/float64(stats.Transmitted)) * 100.0
-	if doStdDev {
-		stats.StdDev = Results.StdDev(stats.Avg)
-	}
-}
-
+/*
+Run count TWAMP tests at the session Interval. Test packets are sent on schedule
+while the reflected packets are collected, so the sending rate is not limited by
+the round-trip time.
+*/
 func (t *TwampFullTest) RunX(count int, callback common.TwampTestCallbackFunction, doneSignal chan bool) *common.PingResults {
 	defer t.Connection.Close()
 
-	Stats := &common.PingResultStats{}
-	Results := &common.PingResults{Stat: Stats}
-	var TotalRTT time.Duration = 0
+	t.engine.Sequence = t.Sequence
+	Results := t.engine.Run(count, callback, doneSignal)
+	t.Sequence = t.engine.Sequence
 
-	terminationRequested := false
-	for i := 0; i < count && !terminationRequested; i++ {
-		select {
-		case <-doneSignal:
-			terminationRequested = true
-		default:
-			Stats.Transmitted++
-			results, err := t.Run()
+	Results.Mode = ModeName(t.GetSession().connection.GetMode())
+	Results.Sid = t.GetSession().GetSid().String()
 
-			if err != nil {
-				// Packet lost somehow
-				log.Printf("%v\n", err)
-			} else {
-				// Packet received
-				if i == 0 {
-					Stats.Min = results.GetRTT()
-					Stats.Max = results.GetRTT()
-				}
-				if Stats.Min > results.GetRTT() {
-					Stats.Min = results.GetRTT()
-				}
-				if Stats.Max < results.GetRTT() {
-					Stats.Max = results.GetRTT()
-				}
-
-				TotalRTT += results.GetRTT()
-				Stats.Received++
-				Results.Results = append(Results.Results, results)
-			}
+	return Results
+}
 
-			t.updateStats(false, TotalRTT, count, Stats, Results)
-			if callback != nil {
-				callback(count, results, Stats)
-			}
+/*
+Run the TWAMP tests of several sessions in parallel and return their results in
+the same order. The callback is called concurrently from every test.
+*/
+func RunTests(tests []*TwampFullTest, count int, callback common.TwampTestCallbackFunction, doneSignal chan bool) []*common.PingResults {
+	results := make([]*common.PingResults, len(tests))
 
-			// Wait in a way can be interrupted by user
-			time.Sleep(t.GetSession().GetConfig().Interval)
-			/*
-				d := t.GetSession().GetConfig().Interval
-				for i := 0; int64(i) < d.Milliseconds() && !terminationRequested; i++ {
-					select {
-					case <-doneSignal:
-						terminationRequested = true
-					default:
-						time.Sleep(1 * time.Millisecond)
-					}
-				}
-			*/
-		}
+	// every test gets its own termination signal
+	signals := make([]chan bool, len(tests))
+	for i := range signals {
+		signals[i] = make(chan bool, 1)
 	}
 
-	t.updateStats(true, TotalRTT, count, Stats, Results)
+	finished := make(chan bool)
+	go func() {
+		select {
+		case <-doneSignal:
+			for _, signal := range signals {
+				signal <- true
+			}
+		case <-finished:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, test := range tests {
+		wg.Add(1)
+		go func(i int, test *TwampFullTest) {
+			defer wg.Done()
+			results[i] = test.RunX(count, callback, signals[i])
+		}(i, test)
+	}
+	wg.Wait()
+	close(finished)
 
-	return Results
+	return results
 }
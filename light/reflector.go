@@ -0,0 +1,199 @@
+package light
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+Size of the Session-Sender packet header: Sequence Number, Timestamp and Error
+Estimate.
+*/
+const senderPacketSize = 14
+
+/*
+Senders not seen for this long are forgotten by a stateful reflector.
+*/
+const senderExpiry = 5 * time.Minute
+
+type senderState struct {
+	sequence uint32
+	lastSeen time.Time
+}
+
+/*
+TWAMP Light Session-Reflector. In stateless mode the Sequence Number of the
+Session-Sender packet is copied into the reflected packet, in stateful mode the
+reflector keeps its own Sequence Number per sender (RFC 5357 Appendix I).
+*/
+type Reflector struct {
+	connection *net.UDPConn
+	stateful   bool
+	senders    map[string]*senderState
+	lastPurge  time.Time
+	format     common.TimestampFormat
+}
+
+/*
+Create a TWAMP Light reflector listening on the given UDP address.
+*/
+func NewReflector(hostname string, port int, stateful bool) (*Reflector, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(hostname, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reflector{
+		connection: conn,
+		stateful:   stateful,
+		senders:    map[string]*senderState{},
+		lastPurge:  time.Now(),
+	}
+
+	// RFC recommends IP TTL of 255
+	err = common.SetPacketOptions(conn, 255, 0)
+	if err != nil {
+		log.Printf("Cannot set TTL of the reflected packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTTL(conn)
+	if err != nil {
+		log.Printf("Cannot receive TTL of the test packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTimestamp(conn)
+	if err != nil {
+		log.Printf("Cannot receive kernel timestamps of the test packets: %v\n", err)
+	}
+
+	return r, nil
+}
+
+/*
+Set the format of the timestamps of the reflected test packets, NTP by default.
+*/
+func (r *Reflector) SetTimestampFormat(format common.TimestampFormat) {
+	r.format = format
+}
+
+/*
+Get the UDP address the reflector is listening on.
+*/
+func (r *Reflector) Addr() net.Addr {
+	return r.connection.LocalAddr()
+}
+
+/*
+Reflect test packets until the reflector is closed.
+*/
+func (r *Reflector) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, info, addr, err := common.ReadWithInfo(r.connection, buf)
+		if err != nil {
+			return err
+		}
+
+		ttl := 0
+		if info.TTL > 0 {
+			ttl = info.TTL
+		}
+
+		err = r.reflect(buf[:n], info.Timestamp, byte(ttl), addr)
+		if err != nil {
+			log.Printf("Cannot reflect test packet from %s: %v\n", addr, err)
+		}
+	}
+}
+
+func (r *Reflector) Close() {
+	r.connection.Close()
+}
+
+/*
+Get the Sequence Number of the next reflected packet.
+*/
+func (r *Reflector) nextSequence(senderSequence uint32, addr net.Addr, received time.Time) uint32 {
+	if !r.stateful {
+		return senderSequence
+	}
+
+	if received.Sub(r.lastPurge) > senderExpiry {
+		for key, sender := range r.senders {
+			if received.Sub(sender.lastSeen) > senderExpiry {
+				delete(r.senders, key)
+			}
+		}
+		r.lastPurge = received
+	}
+
+	sender, ok := r.senders[addr.String()]
+	if !ok {
+		sender = &senderState{}
+		r.senders[addr.String()] = sender
+	}
+
+	sequence := sender.sequence
+	sender.sequence++
+	sender.lastSeen = received
+
+	return sequence
+}
+
+/*
+Build the reflected packet from a received Session-Sender packet and send it back.
+The reflected packet has the size of the received one, the padding is truncated
+by the difference of the header sizes.
+*/
+func (r *Reflector) reflect(pdu []byte, received time.Time, ttl byte, addr net.Addr) error {
+	if len(pdu) < senderPacketSize {
+		return errors.New(fmt.Sprintf("Test packet too short: expected at least %d bytes, got %d.", senderPacketSize, len(pdu)))
+	}
+
+	senderSequence := binary.BigEndian.Uint32(pdu[0:])
+
+	replyHeader := MeasurementPacket{
+		Sequence:         r.nextSequence(senderSequence, addr, received),
+		Timestamp:        *common.NewTwampTimestampFormat(time.Now(), r.format),
+		ErrorEstimate:    common.GetErrorEstimate(r.format),
+		ReceiveTimeStamp: *common.NewTwampTimestampFormat(received, r.format),
+		SenderSequence:   senderSequence,
+		SenderTimeStamp: common.TwampTimestamp{
+			Integer:  binary.BigEndian.Uint32(pdu[4:]),
+			Fraction: binary.BigEndian.Uint32(pdu[8:]),
+		},
+		SenderErrorEstimate: binary.BigEndian.Uint16(pdu[12:]),
+		SenderTtl:           ttl,
+	}
+
+	var binaryBuffer bytes.Buffer
+	err := binary.Write(&binaryBuffer, binary.BigEndian, replyHeader)
+	if err != nil {
+		return err
+	}
+
+	headerSize := binaryBuffer.Len()
+	totalSize := len(pdu)
+	if totalSize < headerSize {
+		totalSize = headerSize
+	}
+
+	reply := make([]byte, totalSize)
+	copy(reply, binaryBuffer.Bytes())
+	copy(reply[headerSize:], pdu[senderPacketSize:])
+
+	_, err = r.connection.WriteTo(reply, addr)
+	return err
+}
@@ -1,9 +1,9 @@
 package light
 
 import (
-	"fmt"
 	"github.com/halacs/twamp/common"
 	"net"
+	"strconv"
 )
 
 type TwampLightSession struct {
@@ -21,7 +21,7 @@ func (s *TwampLightSession) CreateTest() (*TwampLightTest, error) {
 	if err != nil {
 		return nil, err
 	}
-	localAddress := fmt.Sprintf("%s:%d", test.GetLocalTestHost(), s.GetConfig().ReceiverPort)
+	localAddress := net.JoinHostPort(test.GetLocalTestHost(), strconv.Itoa(s.GetConfig().ReceiverPort))
 	localAddr, err := net.ResolveUDPAddr("udp", localAddress)
 	if err != nil {
 		return nil, err
@@ -7,12 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/halacs/twamp/common"
-	"golang.org/x/net/ipv4"
 	"log"
 	"math/rand"
 	"net"
+	"strconv"
 	"time"
-	"unsafe"
 )
 
 /*
@@ -22,27 +21,53 @@ type TwampLightTest struct {
 	Session    *TwampLightSession
 	Connection *net.UDPConn
 	Sequence   uint32
+	engine     *common.Engine
 }
 
 /*
  */
 func (t *TwampLightTest) SetConnection(connection *net.UDPConn) {
-	c := ipv4.NewConn(connection)
-
 	// RFC recommends IP TTL of 255
-	err := c.SetTTL(255)
+	err := common.SetPacketOptions(connection, 255, t.GetSession().GetConfig().TOS)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = c.SetTOS(t.GetSession().GetConfig().TOS)
+	err = common.EnableReceiveTOS(connection)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Cannot receive DSCP and ECN of the reflected packets: %v\n", err)
 	}
 
+	if t.GetSession().GetConfig().KernelTimestamps {
+		err = common.EnableReceiveTimestamp(connection)
+		if err != nil {
+			log.Printf("Cannot receive kernel timestamps of the reflected packets: %v\n", err)
+		}
+	}
+
+	config := t.GetSession().GetConfig()
+	t.engine = common.NewEngine(connection, t, config.Interval, config.GetLossThreshold())
+	t.engine.KeepResults = config.KeepResults
+	t.engine.Percentiles = config.Percentiles
+	t.engine.HistogramBounds = config.HistogramBounds
 	t.Connection = connection
 }
 
+/*
+Get the number of reflected packets received after the loss threshold of their
+test packet. Their test packets are counted as lost.
+*/
+func (t *TwampLightTest) GetLate() int {
+	return t.engine.GetLate()
+}
+
+/*
+Get the number of duplicated reflected packets.
+*/
+func (t *TwampLightTest) GetDuplicates() int {
+	return t.engine.GetDuplicates()
+}
+
 /*
 Get TWAMP Test UDP connection.
 */
@@ -61,7 +86,7 @@ func (t *TwampLightTest) GetSession() *TwampLightSession {
 Get the remote TWAMP IP/UDP address.
 */
 func (t *TwampLightTest) RemoteAddr() (*net.UDPAddr, error) {
-	address := fmt.Sprintf("%s:%d", t.GetRemoteTestHost(), t.GetRemoteTestPort())
+	address := net.JoinHostPort(t.GetRemoteTestHost(), strconv.Itoa(int(t.GetRemoteTestPort())))
 	return net.ResolveUDPAddr("udp", address)
 }
 
@@ -107,62 +132,61 @@ type MeasurementPacket struct {
 Run a TWAMP test and return a pointer to the TwampResult.
 */
 func (t *TwampLightTest) Run() (*common.TwampResult, error) {
-	paddingSize := t.GetSession().config.Padding
-	senderSeqNum := t.Sequence
-
-	size := t.sendTestMessage(t.GetSession().config.UseAllZeros)
-
-	// receive test packets - allocate a receive buffer of a size we expect to receive plus a bit to know if we get some garbage
-	buffer, err := common.ReadFromSocket(t.GetConnection(), (int(unsafe.Sizeof(MeasurementPacket{}))+paddingSize)*2)
-	if err != nil {
-		return nil, err
-	}
-
-	finished := time.Now()
+	t.engine.Sequence = t.Sequence
+	r, err := t.engine.RunOne()
+	t.Sequence = t.engine.Sequence
+	return r, err
+}
 
+/*
+Decode a Session-Reflector packet into a TwampResult.
+*/
+func (t *TwampLightTest) DecodeReflectedPacket(pdu []byte, info common.PacketInfo) (*common.TwampResult, error) {
 	responseHeader := MeasurementPacket{}
-	err = binary.Read(&buffer, binary.BigEndian, &responseHeader)
-	if err != nil {
-		log.Fatalf("Failed to deserialize measurement package. %v", err)
+	headerSize := binary.Size(responseHeader)
+	if len(pdu) < headerSize {
+		return nil, errors.New(fmt.Sprintf("Reflected packet too short: expected at least %d bytes, got %d.", headerSize, len(pdu)))
 	}
 
-	responsePadding := make([]byte, paddingSize, paddingSize)
-	receivedPaddignSize, err := buffer.Read(responsePadding)
+	err := binary.Read(bytes.NewReader(pdu), binary.BigEndian, &responseHeader)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Error when receivin padding. %v\n", err))
-	}
-
-	if receivedPaddignSize != paddingSize {
-		return nil, errors.New(fmt.Sprintf("Incorrect padding. Expected padding size was %d but received %d.\n", paddingSize, receivedPaddignSize))
+		return nil, err
 	}
 
 	// process test results
 	r := &common.TwampResult{}
-	r.SenderSize = size
+	r.ReceiverSize = len(pdu)
 	r.SeqNum = responseHeader.Sequence
-	r.Timestamp = common.NewTimestamp(responseHeader.Timestamp)
-	r.ErrorEstimate = responseHeader.ErrorEstimate
-	r.ReceiveTimestamp = common.NewTimestamp(responseHeader.ReceiveTimeStamp)
+	reflectorFormat := common.TimestampFormatOf(responseHeader.ErrorEstimate)
+	r.Timestamp = common.NewTimestampFormat(responseHeader.Timestamp, reflectorFormat)
+	r.ReceiveTimestamp = common.NewTimestampFormat(responseHeader.ReceiveTimeStamp, reflectorFormat)
 	r.SenderSeqNum = responseHeader.SenderSequence
-	r.SenderTimestamp = common.NewTimestamp(responseHeader.SenderTimeStamp)
-	r.SenderErrorEstimate = responseHeader.SenderErrorEstimate
+	r.SenderTimestamp = common.NewTimestampFormat(responseHeader.SenderTimeStamp, common.TimestampFormatOf(responseHeader.SenderErrorEstimate))
+	r.SetErrorEstimates(responseHeader.ErrorEstimate, responseHeader.SenderErrorEstimate)
 	r.SenderTTL = responseHeader.SenderTtl
-	r.FinishedTimestamp = finished
-
-	if senderSeqNum != r.SenderSeqNum {
-		return nil, errors.New(
-			fmt.Sprintf("Expected Sequence # %d but received %d.\n", senderSeqNum, r.SeqNum),
-		)
-	}
+	r.FinishedTimestamp = info.Timestamp
+	r.SetTOS(t.GetSession().GetConfig().TOS, -1, info.TOS)
 
 	return r, nil
 }
 
-func (t *TwampLightTest) sendTestMessage(useAllZeros bool) int {
+/*
+TWAMP Light reflectors return the padding truncated, there is nothing to check.
+*/
+func (t *TwampLightTest) CheckReflectedPacket(r *common.TwampResult, pdu []byte, sent []byte) error {
+	return nil
+}
+
+/*
+Build the Session-Sender packet of the given Sequence Number.
+*/
+func (t *TwampLightTest) NewTestPacket(sequence uint32) ([]byte, error) {
+	useAllZeros := t.GetSession().config.UseAllZeros
+	format := t.GetSession().config.TimestampFormat
 	packetHeader := MeasurementPacket{
-		Sequence:            t.Sequence,
-		Timestamp:           *common.NewTwampTimestamp(time.Now()),
-		ErrorEstimate:       0x0101,
+		Sequence:            sequence,
+		Timestamp:           *common.NewTwampTimestampFormat(time.Now(), format),
+		ErrorEstimate:       common.GetErrorEstimate(format),
 		MBZ:                 0x0000,
 		ReceiveTimeStamp:    common.TwampTimestamp{},
 		SenderSequence:      0,
@@ -191,7 +215,7 @@ func (t *TwampLightTest) sendTestMessage(useAllZeros bool) int {
 	var binaryBuffer bytes.Buffer
 	err := binary.Write(&binaryBuffer, binary.BigEndian, packetHeader)
 	if err != nil {
-		log.Fatalf("Failed to serialize measurement package. %v", err)
+		return nil, err
 	}
 
 	headerBytes := binaryBuffer.Bytes()
@@ -201,9 +225,7 @@ func (t *TwampLightTest) sendTestMessage(useAllZeros bool) int {
 	copy(pdu[0:], headerBytes)
 	copy(pdu[headerSize:], padding)
 
-	t.GetConnection().Write(pdu)
-	t.Sequence++
-	return totalSize
+	return pdu, nil
 }
 
 func (t *TwampLightTest) FormatJSON(r *common.PingResults) {
@@ -223,11 +245,11 @@ func (t *TwampLightTest) ReturnJSON(r *common.PingResults) string {
 }
 
 func (t *TwampLightTest) Ping(count int, isRapid bool, interval int) *common.PingResults {
-	Stats := &common.PingResultStats{}
+	config := t.GetSession().GetConfig()
+	Stats := common.NewPingResultStats(config.Percentiles, config.HistogramBounds)
 	Results := &common.PingResults{Stat: Stats}
-	var TotalRTT time.Duration = 0
 
-	packetSize := 14 + t.GetSession().GetConfig().Padding
+	packetSize := 14 + config.Padding
 
 	fmt.Printf("TWAMP PING %s: %d data bytes\n", t.GetRemoteTestHost(), packetSize)
 
@@ -238,22 +260,12 @@ func (t *TwampLightTest) Ping(count int, isRapid bool, interval int) *common.Pin
 			// TODO Do we need error logging here? I guess not because dot represents the sort error message here but should be double checked.
 			if isRapid {
 				fmt.Printf(".")
+			} else if common.IsLost(err) {
+				fmt.Printf("Request timeout for twamp_seq=%d\n", t.Sequence-1)
 			}
 		} else {
-			if i == 0 {
-				Stats.Min = results.GetRTT()
-				Stats.Max = results.GetRTT()
-			}
-			if Stats.Min > results.GetRTT() {
-				Stats.Min = results.GetRTT()
-			}
-			if Stats.Max < results.GetRTT() {
-				Stats.Max = results.GetRTT()
-			}
-
-			TotalRTT += results.GetRTT()
-			Stats.Received++
-			Results.Results = append(Results.Results, results)
+			Stats.Count(results)
+			Results.AddResult(results, config.KeepResults)
 
 			if isRapid {
 				fmt.Printf("!")
@@ -277,89 +289,30 @@ func (t *TwampLightTest) Ping(count int, isRapid bool, interval int) *common.Pin
 		fmt.Printf("\n")
 	}
 
-	Stats.Avg = time.Duration(int64(TotalRTT) / int64(count))
 	Stats.Loss = float64(float64(Stats.Transmitted-Stats.Received)/float64(Stats.Transmitted)) * 100.0
-	Stats.StdDev = Results.StdDev(Stats.Avg)
+	Results.UpdateStats()
+	Stats.Late = t.GetLate()
+	t.engine.CountLateReordering(Stats)
+	Stats.SetDuplicates(t.GetDuplicates())
 
 	fmt.Printf("--- %s twamp ping statistics ---\n", t.GetRemoteTestHost())
-	fmt.Printf("%d packets transmitted, %d packets received, %0.1f%% packet loss\n",
-		Stats.Transmitted,
-		Stats.Received,
-		Stats.Loss)
-	fmt.Printf("round-trip min/avg/max/stddev = %0.3f/%0.3f/%0.3f/%0.3f ms\n",
-		(float64(Stats.Min) / float64(time.Millisecond)),
-		(float64(Stats.Avg) / float64(time.Millisecond)),
-		(float64(Stats.Max) / float64(time.Millisecond)),
-		(float64(Stats.StdDev) / float64(time.Millisecond)),
-	)
+	Results.PrintStats(t.GetSession().config.GetLossThreshold())
 	defer t.Connection.Close()
 
 	return Results
 }
 
-func (t *TwampLightTest) updateStats(TotalRTT time.Duration, count int, stats *common.PingResultStats, Results *common.PingResults) {
-	stats.Avg = time.Duration(int64(TotalRTT) / int64(count))
-	stats.Loss = float64(float64(stats.Transmitted-stats.Received)/float64(stats.Transmitted)) * 100.0
-	stats.StdDev = Results.StdDev(stats.Avg)
-}
-
+/*
+Run count TWAMP tests at the session Interval. Test packets are sent on schedule
+while the reflected packets are collected, so the sending rate is not limited by
+the round-trip time.
+*/
 func (t *TwampLightTest) RunX(count int, callback common.TwampTestCallbackFunction, doneSignal chan bool) *common.PingResults {
 	defer t.Connection.Close()
 
-	Stats := &common.PingResultStats{}
-	Results := &common.PingResults{Stat: Stats}
-	var TotalRTT time.Duration = 0
-
-	terminationRequested := false
-	for i := 0; i < count && !terminationRequested; i++ {
-		select {
-		case <-doneSignal:
-			terminationRequested = true
-		default:
-			Stats.Transmitted++
-			results, err := t.Run()
-
-			if err != nil {
-				// Packet lost somehow
-				log.Printf("%v\n", err)
-			} else {
-				// Packet received
-				if i == 0 {
-					Stats.Min = results.GetRTT()
-					Stats.Max = results.GetRTT()
-				}
-				if Stats.Min > results.GetRTT() {
-					Stats.Min = results.GetRTT()
-				}
-				if Stats.Max < results.GetRTT() {
-					Stats.Max = results.GetRTT()
-				}
-
-				TotalRTT += results.GetRTT()
-				Stats.Received++
-				Results.Results = append(Results.Results, results)
-			}
-
-			t.updateStats(TotalRTT, count, Stats, Results)
-			if callback != nil {
-				callback(count, results, Stats)
-			}
-
-			// Wait in a way can be interrupted by user
-			time.Sleep(t.GetSession().GetConfig().Interval)
-			/*
-				d := t.GetSession().GetConfig().Interval
-				for i := 0; int64(i) < d.Milliseconds() && !terminationRequested; i++ {
-					select {
-					case <-doneSignal:
-						terminationRequested = true
-					default:
-						time.Sleep(1 * time.Millisecond)
-					}
-				}
-			*/
-		}
-	}
+	t.engine.Sequence = t.Sequence
+	Results := t.engine.Run(count, callback, doneSignal)
+	t.Sequence = t.engine.Sequence
 
 	return Results
 }
@@ -0,0 +1,40 @@
+package light
+
+import (
+	"net"
+	"testing"
+
+	"github.com/halacs/twamp/common"
+)
+
+func TestReverseTOS(t *testing.T) {
+	reflector, err := NewReflector("127.0.0.1", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go reflector.Serve()
+	defer reflector.Close()
+
+	conn, err := NewLightClient().Connect("127.0.0.1", reflector.Addr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := conn.CreateLightSession(common.TwampSessionConfig{Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test, err := session.CreateTest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer test.Connection.Close()
+
+	// the reflector sends with the default TOS
+	r, err := test.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ReverseTOS != 0 || r.ReverseRemarked {
+		t.Errorf("reverse TOS %d, remarked %v, expected 0 and not remarked", r.ReverseTOS, r.ReverseRemarked)
+	}
+}
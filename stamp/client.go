@@ -0,0 +1,16 @@
+package stamp
+
+type StampClient struct{}
+
+func NewStampClient() *StampClient {
+	return &StampClient{}
+}
+
+/*
+STAMP has no control protocol, the connection only records the address of the
+Session-Reflector. The well-known port is DefaultPort.
+*/
+func (c *StampClient) Connect(hostname string, port int) (*StampConnection, error) {
+	stampConnection := NewStampConnection(hostname, port)
+	return stampConnection, nil
+}
@@ -0,0 +1,29 @@
+package stamp
+
+import (
+	"github.com/halacs/twamp/common"
+)
+
+type StampConnection struct {
+	hostname string
+	port     int
+}
+
+func NewStampConnection(hostname string, port int) *StampConnection {
+	return &StampConnection{
+		hostname: hostname,
+		port:     port,
+	}
+}
+
+/*
+Create a STAMP test session. The Session-Sender Identifier (SSID) of the session
+is taken from the SSID of the configuration.
+*/
+func (c *StampConnection) CreateStampSession(config common.TwampSessionConfig) (*StampSession, error) {
+	session := &StampSession{connection: c, config: config}
+	return session, nil
+}
+
+func (c *StampConnection) Close() {
+}
@@ -0,0 +1,42 @@
+package stamp
+
+import (
+	"github.com/halacs/twamp/common"
+)
+
+/*
+Well-known UDP port of the STAMP Session-Reflector (RFC 8762).
+*/
+const DefaultPort = 862
+
+/*
+STAMP Session-Sender test packet in unauthenticated mode (RFC 8762 section 4.2.1,
+Session-Sender Identifier from RFC 8972 section 3).
+*/
+type SenderPacket struct {
+	Sequence      uint32
+	Timestamp     common.TwampTimestamp
+	ErrorEstimate uint16
+	Ssid          uint16
+	MBZ           [28]byte
+	//Padding []byte
+}
+
+/*
+STAMP Session-Reflector test packet in unauthenticated mode (RFC 8762 section
+4.3.1, Session-Sender Identifier from RFC 8972 section 3).
+*/
+type ReflectorPacket struct {
+	Sequence            uint32
+	Timestamp           common.TwampTimestamp
+	ErrorEstimate       uint16
+	Ssid                uint16
+	ReceiveTimeStamp    common.TwampTimestamp
+	SenderSequence      uint32
+	SenderTimeStamp     common.TwampTimestamp
+	SenderErrorEstimate uint16
+	MBZ1                uint16
+	SenderTtl           byte
+	MBZ2                [3]byte
+	//Padding []byte
+}
@@ -0,0 +1,341 @@
+package stamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+Size of the TWAMP Light Session-Sender packet header: Sequence Number, Timestamp
+and Error Estimate. Shorter packets cannot be reflected.
+*/
+const minimumPacketSize = 14
+
+/*
+Sessions not seen for this long are forgotten by the reflector.
+*/
+const sessionExpiry = 5 * time.Minute
+
+/*
+State of a test session, identified by the sender address and SSID.
+*/
+type sessionState struct {
+	sequence      uint32
+	lastSeen      time.Time
+	received      uint32                // Reflector RxC of the Direct Measurement TLV
+	transmitted   uint32                // Reflector TxC of the Direct Measurement TLV
+	lastSequence  uint32                // Follow-Up Telemetry of the last reflected packet
+	lastTimestamp common.TwampTimestamp // Follow-Up Telemetry of the last reflected packet
+}
+
+/*
+STAMP Session-Reflector. In stateless mode the Sequence Number of the
+Session-Sender packet is copied into the reflected packet, in stateful mode the
+reflector keeps its own Sequence Number per sender address and SSID (RFC 8762
+section 4.3). TWAMP Light Session-Senders are reflected as well.
+
+The TLVs following the base packet are processed as described in RFC 8972. TLVs
+of unknown type are returned unchanged with the U flag set. Padding which is not
+made of TLVs, like the one of TWAMP Light Session-Senders, is returned unchanged.
+*/
+type Reflector struct {
+	connection *net.UDPConn
+	stateful   bool
+	sessions   map[string]*sessionState
+	lastPurge  time.Time
+	hmacKey    []byte
+	format     common.TimestampFormat
+}
+
+/*
+Create a STAMP Session-Reflector listening on the given UDP address.
+*/
+func NewReflector(hostname string, port int, stateful bool) (*Reflector, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(hostname, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", localAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reflector{
+		connection: conn,
+		stateful:   stateful,
+		sessions:   map[string]*sessionState{},
+		lastPurge:  time.Now(),
+	}
+
+	// RFC recommends IP TTL of 255
+	err = common.SetPacketOptions(conn, 255, 0)
+	if err != nil {
+		log.Printf("Cannot set TTL of the reflected packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTTL(conn)
+	if err != nil {
+		log.Printf("Cannot receive TTL of the test packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTimestamp(conn)
+	if err != nil {
+		log.Printf("Cannot receive kernel timestamps of the test packets: %v\n", err)
+	}
+
+	err = common.EnableReceiveTOS(conn)
+	if err != nil {
+		log.Printf("Cannot receive DSCP and ECN of the test packets: %v\n", err)
+	}
+
+	return r, nil
+}
+
+/*
+Set the key verifying the HMAC TLV of the received packets and computing the one
+of the reflected packets. Without a key HMAC TLVs are returned unchanged.
+*/
+func (r *Reflector) SetHMACKey(key []byte) {
+	r.hmacKey = key
+}
+
+/*
+Set the format of the timestamps of the reflected test packets, NTP by default.
+*/
+func (r *Reflector) SetTimestampFormat(format common.TimestampFormat) {
+	r.format = format
+}
+
+/*
+Get the UDP address the reflector is listening on.
+*/
+func (r *Reflector) Addr() net.Addr {
+	return r.connection.LocalAddr()
+}
+
+/*
+Reflect test packets until the reflector is closed.
+*/
+func (r *Reflector) Serve() error {
+	buf := make([]byte, 65536)
+	for {
+		n, info, addr, err := common.ReadWithInfo(r.connection, buf)
+		if err != nil {
+			return err
+		}
+
+		err = r.reflect(buf[:n], info.Timestamp, info, addr)
+		if err != nil {
+			log.Printf("Cannot reflect test packet from %s: %v\n", addr, err)
+		}
+	}
+}
+
+func (r *Reflector) Close() {
+	r.connection.Close()
+}
+
+/*
+Get the state of the test session of a received packet.
+*/
+func (r *Reflector) getSession(ssid uint16, addr net.Addr, received time.Time) *sessionState {
+	if received.Sub(r.lastPurge) > sessionExpiry {
+		for key, session := range r.sessions {
+			if received.Sub(session.lastSeen) > sessionExpiry {
+				delete(r.sessions, key)
+			}
+		}
+		r.lastPurge = received
+	}
+
+	key := fmt.Sprintf("%s/%d", addr, ssid)
+	session, ok := r.sessions[key]
+	if !ok {
+		session = &sessionState{}
+		r.sessions[key] = session
+	}
+	session.lastSeen = received
+
+	return session
+}
+
+/*
+Get the Sequence Number of the next reflected packet.
+*/
+func (r *Reflector) nextSequence(senderSequence uint32, session *sessionState) uint32 {
+	if !r.stateful {
+		return senderSequence
+	}
+
+	sequence := session.sequence
+	session.sequence++
+
+	return sequence
+}
+
+/*
+Build the reflected packet from a received Session-Sender packet and send it back.
+The reflected packet has the size of the received one (symmetrical size), but at
+least the size of the Session-Reflector packet. The octets following the
+Session-Sender packet header are returned unchanged.
+*/
+func (r *Reflector) reflect(pdu []byte, received time.Time, info common.PacketInfo, addr *net.UDPAddr) error {
+	if len(pdu) < minimumPacketSize {
+		return errors.New(fmt.Sprintf("Test packet too short: expected at least %d bytes, got %d.", minimumPacketSize, len(pdu)))
+	}
+
+	// TWAMP Light Session-Senders may send packets shorter than the STAMP header
+	senderHeader := SenderPacket{}
+	header := make([]byte, binary.Size(senderHeader))
+	copy(header, pdu)
+	err := binary.Read(bytes.NewReader(header), binary.BigEndian, &senderHeader)
+	if err != nil {
+		return err
+	}
+
+	session := r.getSession(senderHeader.Ssid, addr, received)
+	session.received++
+
+	ttl := byte(0)
+	if info.TTL > 0 {
+		ttl = byte(info.TTL)
+	}
+
+	replyHeader := ReflectorPacket{
+		Sequence:            r.nextSequence(senderHeader.Sequence, session),
+		ErrorEstimate:       common.GetErrorEstimate(r.format),
+		Ssid:                senderHeader.Ssid,
+		ReceiveTimeStamp:    *common.NewTwampTimestampFormat(received, r.format),
+		SenderSequence:      senderHeader.Sequence,
+		SenderTimeStamp:     senderHeader.Timestamp,
+		SenderErrorEstimate: senderHeader.ErrorEstimate,
+		SenderTtl:           ttl,
+	}
+
+	headerSize := binary.Size(replyHeader)
+	totalSize := len(pdu)
+	if totalSize < headerSize {
+		totalSize = headerSize
+	}
+
+	reply := make([]byte, totalSize)
+	tos := -1
+	hasTLVs := len(pdu) > headerSize && isTLVStream(pdu[headerSize:])
+	if len(pdu) > headerSize {
+		copy(reply[headerSize:], pdu[headerSize:])
+	}
+	if hasTLVs {
+		integrity := r.hmacKey == nil || verifyTLVs(r.hmacKey, pdu, headerSize)
+		tos = r.processTLVs(reply[headerSize:], session, info, addr, integrity)
+	}
+
+	replyHeader.Timestamp = *common.NewTwampTimestampFormat(time.Now(), r.format)
+
+	var binaryBuffer bytes.Buffer
+	err = binary.Write(&binaryBuffer, binary.BigEndian, replyHeader)
+	if err != nil {
+		return err
+	}
+	copy(reply, binaryBuffer.Bytes())
+
+	if r.hmacKey != nil && hasTLVs {
+		signTLVs(r.hmacKey, reply, headerSize)
+	}
+
+	// the reflected packet of a Class of Service TLV uses the requested DSCP
+	_, err = common.WriteWithTOS(r.connection, reply, addr, tos)
+	if err != nil {
+		return err
+	}
+
+	session.transmitted++
+	session.lastSequence = replyHeader.Sequence
+	session.lastTimestamp = replyHeader.Timestamp
+	return nil
+}
+
+/*
+Process the TLVs of a reflected packet in place and return the TOS requested for
+the reflected packet, -1 without Class of Service TLV. The TLVs are checked by
+isTLVStream, a TLV whose value is malformed gets the M flag.
+*/
+func (r *Reflector) processTLVs(tlvs []byte, session *sessionState, info common.PacketInfo, addr *net.UDPAddr, integrity bool) int {
+	tos := -1
+
+	for offset := 0; offset < len(tlvs); {
+		length := int(binary.BigEndian.Uint16(tlvs[offset+2:]))
+		value := tlvs[offset+tlvHeaderSize : offset+tlvHeaderSize+length]
+		var err error
+
+		switch tlvs[offset+1] {
+		case TLVExtraPadding, TLVAccessReport:
+			// returned unchanged
+		case TLVLocation:
+			local, _ := r.connection.LocalAddr().(*net.UDPAddr)
+			err = fillLocation(value, addr, local)
+		case TLVTimestampInfo:
+			syncSource := byte(SyncSourceNTP)
+			if r.format == common.TimestampPTP {
+				syncSource = SyncSourcePTP
+			}
+			timestampInfo := &TimestampInfo{syncSource, TimestampSoftware, syncSource, TimestampSoftware}
+			err = fillValue(value, timestampInfo.TLV())
+		case TLVClassOfService:
+			var cos *ClassOfService
+			cos, err = DecodeClassOfService(TLV{Type: TLVClassOfService, Value: value})
+			if err == nil {
+				if info.TOS >= 0 {
+					cos.DSCP2 = byte(info.TOS >> 2)
+					cos.ECN = byte(info.TOS & 0x03)
+				}
+				tos = int(cos.DSCP1) << 2
+				err = fillValue(value, cos.TLV())
+			}
+		case TLVDirectMeasurement:
+			var counters *DirectMeasurement
+			counters, err = DecodeDirectMeasurement(TLV{Type: TLVDirectMeasurement, Value: value})
+			if err == nil {
+				counters.ReflectorRxC = session.received
+				counters.ReflectorTxC = session.transmitted + 1
+				err = fillValue(value, counters.TLV())
+			}
+		case TLVFollowUpTelemetry:
+			followUp := &FollowUpTelemetry{session.lastSequence, session.lastTimestamp, TimestampSoftware}
+			err = fillValue(value, followUp.TLV())
+		case TLVHMAC:
+			if !integrity {
+				tlvs[offset] |= TLVFlagIntegrity
+			}
+		default:
+			tlvs[offset] |= TLVFlagUnrecognized
+		}
+
+		if err != nil {
+			tlvs[offset] |= TLVFlagMalformed
+		}
+
+		offset += tlvHeaderSize + length
+	}
+
+	return tos
+}
+
+/*
+Overwrite a TLV value in place with the value of the same length filled in by
+the reflector.
+*/
+func fillValue(value []byte, tlv TLV) error {
+	if len(value) != len(tlv.Value) {
+		return errTLVSize(tlv.Type, len(value), len(tlv.Value))
+	}
+	copy(value, tlv.Value)
+	return nil
+}
@@ -0,0 +1,71 @@
+package stamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/halacs/twamp/common"
+)
+
+func TestReflectPadding(t *testing.T) {
+	r, err := NewReflector("127.0.0.1", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.Serve()
+	defer r.Close()
+
+	conn, err := net.DialUDP("udp", nil, r.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = common.EnableReceiveTOS(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cos := &ClassOfService{DSCP1: common.EF >> 2}
+	unknown := TLV{Type: 200, Value: []byte{1, 2, 3, 4}}
+	unrecognized := unknown
+	unrecognized.Flags = TLVFlagUnrecognized
+
+	// in sending order, the TOS of a Class of Service TLV is not kept
+	tests := []struct {
+		name      string
+		padding   []byte
+		reflected []byte
+		tos       int
+	}{
+		{"TWAMP Light padding", make([]byte, 8), make([]byte, 8), 0},
+		{"Class of Service", EncodeTLVs([]TLV{cos.TLV()}), nil, common.EF},
+		{"unknown TLV", EncodeTLVs([]TLV{unknown}), EncodeTLVs([]TLV{unrecognized}), 0},
+	}
+
+	headerSize := binary.Size(SenderPacket{})
+	buf := make([]byte, 1500)
+	for _, test := range tests {
+		packet := append(make([]byte, headerSize), test.padding...)
+		_, err := conn.Write(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, info, _, err := common.ReadWithInfo(conn, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		padding := buf[binary.Size(ReflectorPacket{}):n]
+		if test.reflected != nil && !bytes.Equal(padding, test.reflected) {
+			t.Errorf("%s: reflected %x, expected %x", test.name, padding, test.reflected)
+		}
+		if info.TOS != test.tos {
+			t.Errorf("%s: reflected with TOS %#x, expected %#x", test.name, info.TOS, test.tos)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package stamp
+
+import (
+	"github.com/halacs/twamp/common"
+	"net"
+)
+
+type StampSession struct {
+	connection *StampConnection
+	config     common.TwampSessionConfig
+	tlvs       []TLV
+	hmacKey    []byte
+}
+
+func (s *StampSession) GetConfig() common.TwampSessionConfig {
+	return s.config
+}
+
+/*
+Get the Session-Sender Identifier (SSID) of the session.
+*/
+func (s *StampSession) GetSsid() uint16 {
+	return s.config.SSID
+}
+
+/*
+Set the TLVs sent after the base packet (RFC 8972). With TLVs the padding of the
+configuration is sent in an Extra Padding TLV. The Sender TxC of a Direct
+Measurement TLV and the value of an HMAC TLV are filled in for every packet.
+*/
+func (s *StampSession) SetTLVs(tlvs ...TLV) {
+	s.tlvs = tlvs
+}
+
+/*
+Set the key of the HMAC TLV, used to sign the sent packets and to verify the
+reflected ones.
+*/
+func (s *StampSession) SetHMACKey(key []byte) {
+	s.hmacKey = key
+}
+
+func (s *StampSession) findTLV(tlvType byte) *TLV {
+	for i := range s.tlvs {
+		if s.tlvs[i].Type == tlvType {
+			return &s.tlvs[i]
+		}
+	}
+	return nil
+}
+
+func (s *StampSession) CreateTest() (*StampTest, error) {
+	test := &StampTest{Session: s}
+	remoteAddr, err := test.RemoteAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	var localAddr *net.UDPAddr
+	if s.GetConfig().SenderPort != 0 {
+		localAddr = &net.UDPAddr{Port: s.GetConfig().SenderPort}
+	}
+
+	conn, err := net.DialUDP("udp", localAddr, remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	test.SetConnection(conn)
+
+	return test, nil
+}
+
+func (s *StampSession) Stop() {
+}
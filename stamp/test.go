@@ -0,0 +1,385 @@
+package stamp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+STAMP test connection of the Session-Sender.
+*/
+type StampTest struct {
+	Session    *StampSession
+	Connection *net.UDPConn
+	Sequence   uint32
+	reflected  []TLV // TLVs of the last reflected packet
+	mutex      sync.Mutex
+	engine     *common.Engine
+}
+
+/*
+ */
+func (t *StampTest) SetConnection(connection *net.UDPConn) {
+	// RFC recommends IP TTL of 255
+	err := common.SetPacketOptions(connection, 255, t.GetSession().GetConfig().TOS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = common.EnableReceiveTOS(connection)
+	if err != nil {
+		log.Printf("Cannot receive DSCP and ECN of the reflected packets: %v\n", err)
+	}
+
+	if t.GetSession().GetConfig().KernelTimestamps {
+		err = common.EnableReceiveTimestamp(connection)
+		if err != nil {
+			log.Printf("Cannot receive kernel timestamps of the reflected packets: %v\n", err)
+		}
+	}
+
+	config := t.GetSession().GetConfig()
+	t.engine = common.NewEngine(connection, t, config.Interval, config.GetLossThreshold())
+	t.engine.KeepResults = config.KeepResults
+	t.engine.Percentiles = config.Percentiles
+	t.engine.HistogramBounds = config.HistogramBounds
+	t.Connection = connection
+}
+
+/*
+Get the number of reflected packets received after the loss threshold of their
+test packet. Their test packets are counted as lost.
+*/
+func (t *StampTest) GetLate() int {
+	return t.engine.GetLate()
+}
+
+/*
+Get the number of duplicated reflected packets.
+*/
+func (t *StampTest) GetDuplicates() int {
+	return t.engine.GetDuplicates()
+}
+
+/*
+Get the TLVs of the last reflected packet, as returned by the Session-Reflector.
+*/
+func (t *StampTest) GetReflectedTLVs() []TLV {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.reflected
+}
+
+/*
+Set the TLVs of the last reflected packet. The reflected packets are decoded by
+the receiver of the test engine.
+*/
+func (t *StampTest) setReflectedTLVs(tlvs []TLV) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.reflected = tlvs
+}
+
+/*
+Get STAMP Test UDP connection.
+*/
+func (t *StampTest) GetConnection() *net.UDPConn {
+	return t.Connection
+}
+
+/*
+Get the underlying STAMP Session for the STAMP test.
+*/
+func (t *StampTest) GetSession() *StampSession {
+	return t.Session
+}
+
+/*
+Get the remote STAMP IP/UDP address.
+*/
+func (t *StampTest) RemoteAddr() (*net.UDPAddr, error) {
+	address := net.JoinHostPort(t.GetRemoteTestHost(), strconv.Itoa(t.GetRemoteTestPort()))
+	return net.ResolveUDPAddr("udp", address)
+}
+
+/*
+Get the remote STAMP UDP port number.
+*/
+func (t *StampTest) GetRemoteTestPort() int {
+	return t.GetSession().connection.port
+}
+
+/*
+Get the remote IP address of the Session-Reflector.
+*/
+func (t *StampTest) GetRemoteTestHost() string {
+	return t.GetSession().connection.hostname
+}
+
+/*
+Run a STAMP test and return a pointer to the TwampResult.
+*/
+func (t *StampTest) Run() (*common.TwampResult, error) {
+	t.engine.Sequence = t.Sequence
+	r, err := t.engine.RunOne()
+	t.Sequence = t.engine.Sequence
+	return r, err
+}
+
+/*
+Decode a Session-Reflector packet into a TwampResult.
+*/
+func (t *StampTest) DecodeReflectedPacket(pdu []byte, info common.PacketInfo) (*common.TwampResult, error) {
+	headerSize := binary.Size(ReflectorPacket{})
+	if len(pdu) < headerSize {
+		return nil, errors.New(fmt.Sprintf("Reflected packet too short: expected at least %d bytes, got %d.", headerSize, len(pdu)))
+	}
+
+	responseHeader := ReflectorPacket{}
+	err := binary.Read(bytes.NewReader(pdu), binary.BigEndian, &responseHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if responseHeader.Ssid != t.GetSession().GetSsid() {
+		return nil, fmt.Errorf("Expected SSID %d but received %d.", t.GetSession().GetSsid(), responseHeader.Ssid)
+	}
+
+	// process test results
+	r := &common.TwampResult{}
+	r.ReceiverSize = len(pdu)
+	r.SeqNum = responseHeader.Sequence
+	reflectorFormat := common.TimestampFormatOf(responseHeader.ErrorEstimate)
+	r.Timestamp = common.NewTimestampFormat(responseHeader.Timestamp, reflectorFormat)
+	r.ReceiveTimestamp = common.NewTimestampFormat(responseHeader.ReceiveTimeStamp, reflectorFormat)
+	r.SenderSeqNum = responseHeader.SenderSequence
+	r.SenderTimestamp = common.NewTimestampFormat(responseHeader.SenderTimeStamp, common.TimestampFormatOf(responseHeader.SenderErrorEstimate))
+	r.SetErrorEstimates(responseHeader.ErrorEstimate, responseHeader.SenderErrorEstimate)
+	r.SenderTTL = responseHeader.SenderTtl
+	r.FinishedTimestamp = info.Timestamp
+	r.SetTOS(t.GetSession().GetConfig().TOS, -1, info.TOS)
+
+	err = t.decodeTLVs(pdu, headerSize, r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+/*
+Reflected STAMP packets are checked while decoding.
+*/
+func (t *StampTest) CheckReflectedPacket(r *common.TwampResult, pdu []byte, sent []byte) error {
+	return nil
+}
+
+/*
+Decode the TLVs of a reflected packet. The TOS received by the reflector and the
+TOS of the reflected packet are checked with the Class of Service TLV.
+*/
+func (t *StampTest) decodeTLVs(pdu []byte, headerSize int, r *common.TwampResult, info common.PacketInfo) error {
+	t.setReflectedTLVs(nil)
+	if len(t.GetSession().tlvs) == 0 || len(pdu) <= headerSize {
+		return nil
+	}
+
+	if t.GetSession().hmacKey != nil && !verifyTLVs(t.GetSession().hmacKey, pdu, headerSize) {
+		return errors.New("HMAC TLV of the reflected packet failed verification.")
+	}
+
+	tlvs, err := DecodeTLVs(pdu[headerSize:])
+	if err != nil {
+		return err
+	}
+	t.setReflectedTLVs(tlvs)
+
+	for _, tlv := range tlvs {
+		if tlv.Type != TLVClassOfService || tlv.Flags&(TLVFlagUnrecognized|TLVFlagMalformed) != 0 {
+			continue
+		}
+
+		cos, err := DecodeClassOfService(tlv)
+		if err != nil {
+			return err
+		}
+
+		r.SetTOS(t.GetSession().GetConfig().TOS, int(cos.DSCP2)<<2|int(cos.ECN), -1)
+		if info.TOS >= 0 {
+			r.ReverseTOS = info.TOS
+			r.ReverseRemarked = byte(info.TOS>>2) != cos.DSCP1
+		}
+	}
+
+	return nil
+}
+
+/*
+Build the TLVs of the next Session-Sender packet.
+*/
+func (t *StampTest) encodeTLVs(sequence uint32, padding []byte) []byte {
+	tlvs := []TLV{}
+	if len(padding) > 0 {
+		tlvs = append(tlvs, TLV{Type: TLVExtraPadding, Value: padding})
+	}
+
+	for _, tlv := range t.GetSession().tlvs {
+		if tlv.Type == TLVDirectMeasurement {
+			counters := &DirectMeasurement{SenderTxC: sequence + 1}
+			tlv = counters.TLV()
+		}
+		tlvs = append(tlvs, tlv)
+	}
+
+	return EncodeTLVs(tlvs)
+}
+
+/*
+Build the Session-Sender packet of the given Sequence Number.
+*/
+func (t *StampTest) NewTestPacket(sequence uint32) ([]byte, error) {
+	useAllZeros := t.GetSession().config.UseAllZeros
+	format := t.GetSession().config.TimestampFormat
+	packetHeader := SenderPacket{
+		Sequence:      sequence,
+		Timestamp:     *common.NewTwampTimestampFormat(time.Now(), format),
+		ErrorEstimate: common.GetErrorEstimate(format),
+		Ssid:          t.GetSession().GetSsid(),
+	}
+
+	paddingSize := t.GetSession().config.Padding
+	padding := make([]byte, paddingSize, paddingSize)
+
+	for x := 0; x < paddingSize; x++ {
+		if !useAllZeros {
+			padding[x] = byte(rand.Intn(256))
+		}
+	}
+
+	var binaryBuffer bytes.Buffer
+	err := binary.Write(&binaryBuffer, binary.BigEndian, packetHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	// with TLVs the padding is carried in an Extra Padding TLV
+	if len(t.GetSession().tlvs) > 0 {
+		padding = t.encodeTLVs(sequence, padding)
+		paddingSize = len(padding)
+	}
+
+	headerBytes := binaryBuffer.Bytes()
+	headerSize := binaryBuffer.Len()
+	totalSize := headerSize + paddingSize
+	var pdu []byte = make([]byte, totalSize)
+	copy(pdu[0:], headerBytes)
+	copy(pdu[headerSize:], padding)
+
+	if t.GetSession().hmacKey != nil {
+		signTLVs(t.GetSession().hmacKey, pdu, headerSize)
+	}
+
+	return pdu, nil
+}
+
+func (t *StampTest) FormatJSON(r *common.PingResults) {
+	doc, err := json.Marshal(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s\n", string(doc))
+}
+
+func (t *StampTest) ReturnJSON(r *common.PingResults) string {
+	doc, err := json.Marshal(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return fmt.Sprintf("%s\n", string(doc))
+}
+
+func (t *StampTest) Ping(count int, isRapid bool, interval int) *common.PingResults {
+	config := t.GetSession().GetConfig()
+	Stats := common.NewPingResultStats(config.Percentiles, config.HistogramBounds)
+	Results := &common.PingResults{Stat: Stats, Sid: strconv.Itoa(int(t.GetSession().GetSsid()))}
+
+	packetSize := binary.Size(SenderPacket{}) + config.Padding
+
+	fmt.Printf("STAMP PING %s: %d data bytes, SSID %d\n", t.GetRemoteTestHost(), packetSize, t.GetSession().GetSsid())
+
+	for i := 0; i < count; i++ {
+		Stats.Transmitted++
+		results, err := t.Run()
+		if err != nil {
+			if isRapid {
+				fmt.Printf(".")
+			} else if common.IsLost(err) {
+				fmt.Printf("Request timeout for stamp_seq=%d\n", t.Sequence-1)
+			}
+		} else {
+			Stats.Count(results)
+			Results.AddResult(results, config.KeepResults)
+
+			if isRapid {
+				fmt.Printf("!")
+			} else {
+				fmt.Printf("%d bytes from %s: stamp_seq=%d ttl=%d time=%0.03f ms\n",
+					results.ReceiverSize,
+					t.GetRemoteTestHost(),
+					results.SenderSeqNum,
+					results.SenderTTL,
+					(float64(results.GetRTT()) / float64(time.Millisecond)),
+				)
+			}
+		}
+
+		if !isRapid {
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}
+
+	if isRapid {
+		fmt.Printf("\n")
+	}
+
+	Stats.Loss = float64(float64(Stats.Transmitted-Stats.Received)/float64(Stats.Transmitted)) * 100.0
+	Results.UpdateStats()
+	Stats.Late = t.GetLate()
+	t.engine.CountLateReordering(Stats)
+	Stats.SetDuplicates(t.GetDuplicates())
+
+	fmt.Printf("--- %s stamp ping statistics ---\n", t.GetRemoteTestHost())
+	Results.PrintStats(t.GetSession().config.GetLossThreshold())
+	defer t.Connection.Close()
+
+	return Results
+}
+
+/*
+Run count STAMP tests at the session Interval. Test packets are sent on schedule
+while the reflected packets are collected, so the sending rate is not limited by
+the round-trip time.
+*/
+func (t *StampTest) RunX(count int, callback common.TwampTestCallbackFunction, doneSignal chan bool) *common.PingResults {
+	defer t.Connection.Close()
+
+	t.engine.Sequence = t.Sequence
+	Results := t.engine.Run(count, callback, doneSignal)
+	t.Sequence = t.engine.Sequence
+
+	Results.Sid = strconv.Itoa(int(t.GetSession().GetSsid()))
+
+	return Results
+}
@@ -0,0 +1,498 @@
+package stamp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/halacs/twamp/common"
+	"net"
+)
+
+/*
+STAMP TLV types (RFC 8972 section 4).
+*/
+const (
+	TLVExtraPadding      = 1
+	TLVLocation          = 2
+	TLVTimestampInfo     = 3
+	TLVClassOfService    = 4
+	TLVDirectMeasurement = 5
+	TLVAccessReport      = 6
+	TLVFollowUpTelemetry = 7
+	TLVHMAC              = 8
+)
+
+/*
+STAMP TLV flags set by the Session-Reflector (RFC 8972 section 4).
+*/
+const (
+	TLVFlagUnrecognized = 0x80 // U: the TLV type is not known by the reflector
+	TLVFlagMalformed    = 0x40 // M: the TLV is malformed
+	TLVFlagIntegrity    = 0x20 // I: the HMAC TLV failed verification
+)
+
+/*
+Location sub-TLV types (RFC 8972 section 4.2).
+*/
+const (
+	LocationSourceMAC       = 1
+	LocationSourceEUI64     = 2
+	LocationDestinationIPv4 = 3
+	LocationDestinationIPv6 = 4
+	LocationSourceIPv4      = 5
+	LocationSourceIPv6      = 6
+)
+
+/*
+Synchronization sources of the Timestamp Information TLV (RFC 8972 section 4.3).
+*/
+const (
+	SyncSourceNTP         = 1
+	SyncSourcePTP         = 2
+	SyncSourceSSU         = 3
+	SyncSourceGNSS        = 4
+	SyncSourceFreeRunning = 5
+)
+
+/*
+Timestamping methods of the Timestamp Information and Follow-Up Telemetry TLVs
+(RFC 8972 section 4.3).
+*/
+const (
+	TimestampHardware     = 1
+	TimestampSoftware     = 2
+	TimestampControlPlane = 3
+)
+
+/*
+Size of the TLV header and of the fixed TLV values.
+*/
+const (
+	tlvHeaderSize         = 4
+	hmacSize              = 16
+	locationHeaderSize    = 4
+	timestampInfoSize     = 4
+	classOfServiceSize    = 4
+	directMeasurementSize = 12
+	accessReportSize      = 4
+	followUpTelemetrySize = 16
+)
+
+/*
+STAMP TLV: Flags, Type and the Value, which is Length octets long. TLVs of
+unknown type are kept as they are, so they are returned unchanged.
+*/
+type TLV struct {
+	Flags byte
+	Type  byte
+	Value []byte
+}
+
+/*
+Get the size of the encoded TLV.
+*/
+func (t TLV) Size() int {
+	return tlvHeaderSize + len(t.Value)
+}
+
+/*
+Encode the TLV into buf, which must be at least Size() long.
+*/
+func (t TLV) encode(buf []byte) int {
+	buf[0] = t.Flags
+	buf[1] = t.Type
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(t.Value)))
+	copy(buf[tlvHeaderSize:], t.Value)
+	return t.Size()
+}
+
+/*
+Encode a list of TLVs.
+*/
+func EncodeTLVs(tlvs []TLV) []byte {
+	size := 0
+	for _, tlv := range tlvs {
+		size += tlv.Size()
+	}
+
+	buf := make([]byte, size)
+	offset := 0
+	for _, tlv := range tlvs {
+		offset += tlv.encode(buf[offset:])
+	}
+	return buf
+}
+
+/*
+Decode the TLVs following the base STAMP packet. The TLVs decoded before a
+malformed one are returned together with the error.
+*/
+func DecodeTLVs(buf []byte) ([]TLV, error) {
+	tlvs := []TLV{}
+	for offset := 0; offset < len(buf); {
+		if len(buf)-offset < tlvHeaderSize {
+			return tlvs, errors.New(fmt.Sprintf("Truncated TLV header at offset %d.", offset))
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[offset+2:]))
+		if offset+tlvHeaderSize+length > len(buf) {
+			return tlvs, errors.New(fmt.Sprintf("TLV of type %d at offset %d overruns the packet.", buf[offset+1], offset))
+		}
+
+		value := make([]byte, length)
+		copy(value, buf[offset+tlvHeaderSize:])
+		tlvs = append(tlvs, TLV{Flags: buf[offset], Type: buf[offset+1], Value: value})
+
+		offset += tlvHeaderSize + length
+	}
+	return tlvs, nil
+}
+
+/*
+Check whether the octets following the base STAMP packet are TLVs. The padding of
+TWAMP Light Session-Senders is not, zero padding reads as TLVs of the reserved
+type 0.
+*/
+func isTLVStream(buf []byte) bool {
+	tlvs, err := DecodeTLVs(buf)
+	if err != nil || len(tlvs) == 0 {
+		return false
+	}
+	for _, tlv := range tlvs {
+		if tlv.Type == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func errTLVSize(tlvType byte, size int, expected int) error {
+	return errors.New(fmt.Sprintf("Malformed TLV of type %d: expected %d octets, got %d.", tlvType, expected, size))
+}
+
+/*
+Create an Extra Padding TLV with the given number of octets of value.
+*/
+func NewExtraPaddingTLV(size int) TLV {
+	return TLV{Type: TLVExtraPadding, Value: make([]byte, size)}
+}
+
+/*
+Location TLV: the ports and addresses of the test packet as seen by the
+Session-Reflector.
+*/
+type Location struct {
+	DestinationPort    uint16
+	SourcePort         uint16
+	DestinationAddress net.IP
+	SourceAddress      net.IP
+}
+
+/*
+Create an empty Location TLV with room for IPv4 or IPv6 addresses, filled in by
+the Session-Reflector.
+*/
+func NewLocationTLV(ipv6 bool) TLV {
+	location := &Location{DestinationAddress: net.IPv4zero.To4(), SourceAddress: net.IPv4zero.To4()}
+	if ipv6 {
+		location.DestinationAddress = net.IPv6zero
+		location.SourceAddress = net.IPv6zero
+	}
+	return location.TLV()
+}
+
+func (l *Location) TLV() TLV {
+	subTLVs := []TLV{}
+	if ip4 := l.DestinationAddress.To4(); ip4 != nil {
+		subTLVs = append(subTLVs, TLV{Type: LocationDestinationIPv4, Value: append([]byte{}, ip4...)})
+	} else if l.DestinationAddress != nil {
+		subTLVs = append(subTLVs, TLV{Type: LocationDestinationIPv6, Value: append([]byte{}, l.DestinationAddress.To16()...)})
+	}
+	if ip4 := l.SourceAddress.To4(); ip4 != nil {
+		subTLVs = append(subTLVs, TLV{Type: LocationSourceIPv4, Value: append([]byte{}, ip4...)})
+	} else if l.SourceAddress != nil {
+		subTLVs = append(subTLVs, TLV{Type: LocationSourceIPv6, Value: append([]byte{}, l.SourceAddress.To16()...)})
+	}
+
+	value := make([]byte, locationHeaderSize)
+	binary.BigEndian.PutUint16(value[0:], l.DestinationPort)
+	binary.BigEndian.PutUint16(value[2:], l.SourcePort)
+	value = append(value, EncodeTLVs(subTLVs)...)
+
+	return TLV{Type: TLVLocation, Value: value}
+}
+
+func DecodeLocation(t TLV) (*Location, error) {
+	if len(t.Value) < locationHeaderSize {
+		return nil, errTLVSize(t.Type, len(t.Value), locationHeaderSize)
+	}
+
+	location := &Location{
+		DestinationPort: binary.BigEndian.Uint16(t.Value[0:]),
+		SourcePort:      binary.BigEndian.Uint16(t.Value[2:]),
+	}
+
+	subTLVs, err := DecodeTLVs(t.Value[locationHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subTLVs {
+		switch sub.Type {
+		case LocationDestinationIPv4, LocationDestinationIPv6:
+			location.DestinationAddress = net.IP(sub.Value)
+		case LocationSourceIPv4, LocationSourceIPv6:
+			location.SourceAddress = net.IP(sub.Value)
+		}
+	}
+
+	return location, nil
+}
+
+/*
+Fill in the Location TLV value in place: the ports and the address sub-TLVs the
+Session-Sender made room for.
+*/
+func fillLocation(value []byte, source *net.UDPAddr, destination *net.UDPAddr) error {
+	if len(value) < locationHeaderSize {
+		return errTLVSize(TLVLocation, len(value), locationHeaderSize)
+	}
+
+	binary.BigEndian.PutUint16(value[0:], uint16(destination.Port))
+	binary.BigEndian.PutUint16(value[2:], uint16(source.Port))
+
+	for offset := locationHeaderSize; offset < len(value); {
+		if len(value)-offset < tlvHeaderSize {
+			return errors.New("Truncated Location sub-TLV.")
+		}
+
+		length := int(binary.BigEndian.Uint16(value[offset+2:]))
+		if offset+tlvHeaderSize+length > len(value) {
+			return errors.New("Location sub-TLV overruns the TLV.")
+		}
+
+		address := value[offset+tlvHeaderSize : offset+tlvHeaderSize+length]
+		switch value[offset+1] {
+		case LocationDestinationIPv4, LocationDestinationIPv6:
+			copyAddress(address, destination.IP)
+		case LocationSourceIPv4, LocationSourceIPv6:
+			copyAddress(address, source.IP)
+		default:
+			value[offset] |= TLVFlagUnrecognized
+		}
+
+		offset += tlvHeaderSize + length
+	}
+
+	return nil
+}
+
+func copyAddress(buf []byte, ip net.IP) {
+	if ip4 := ip.To4(); len(buf) == net.IPv4len && ip4 != nil {
+		copy(buf, ip4)
+	} else if len(buf) == net.IPv6len {
+		copy(buf, ip.To16())
+	}
+}
+
+/*
+Timestamp Information TLV: synchronization source and timestamping method of the
+Session-Reflector receive (In) and transmit (Out) timestamps.
+*/
+type TimestampInfo struct {
+	SyncSourceIn  byte
+	TimestampIn   byte
+	SyncSourceOut byte
+	TimestampOut  byte
+}
+
+func (i *TimestampInfo) TLV() TLV {
+	return TLV{Type: TLVTimestampInfo, Value: []byte{i.SyncSourceIn, i.TimestampIn, i.SyncSourceOut, i.TimestampOut}}
+}
+
+func DecodeTimestampInfo(t TLV) (*TimestampInfo, error) {
+	if len(t.Value) < timestampInfoSize {
+		return nil, errTLVSize(t.Type, len(t.Value), timestampInfoSize)
+	}
+	return &TimestampInfo{
+		SyncSourceIn:  t.Value[0],
+		TimestampIn:   t.Value[1],
+		SyncSourceOut: t.Value[2],
+		TimestampOut:  t.Value[3],
+	}, nil
+}
+
+/*
+Class of Service TLV. DSCP1 is the DSCP the Session-Sender asks for in the
+reflected packet, DSCP2 and ECN are the values received by the Session-Reflector.
+RP is set by the reflector when DSCP1 could not be used for the reflected packet.
+*/
+type ClassOfService struct {
+	DSCP1 byte
+	DSCP2 byte
+	ECN   byte
+	RP    byte
+}
+
+func (c *ClassOfService) TLV() TLV {
+	value := make([]byte, classOfServiceSize)
+	value[0] = c.DSCP1<<2 | c.DSCP2>>4
+	value[1] = c.DSCP2<<4 | (c.ECN&0x03)<<2 | c.RP&0x03
+	return TLV{Type: TLVClassOfService, Value: value}
+}
+
+func DecodeClassOfService(t TLV) (*ClassOfService, error) {
+	if len(t.Value) < classOfServiceSize {
+		return nil, errTLVSize(t.Type, len(t.Value), classOfServiceSize)
+	}
+	return &ClassOfService{
+		DSCP1: t.Value[0] >> 2,
+		DSCP2: (t.Value[0]&0x03)<<4 | t.Value[1]>>4,
+		ECN:   (t.Value[1] >> 2) & 0x03,
+		RP:    t.Value[1] & 0x03,
+	}, nil
+}
+
+/*
+Direct Measurement TLV: packet counters of the Session-Sender and the
+Session-Reflector, giving direct loss measurement per direction.
+*/
+type DirectMeasurement struct {
+	SenderTxC    uint32
+	ReflectorRxC uint32
+	ReflectorTxC uint32
+}
+
+func (d *DirectMeasurement) TLV() TLV {
+	value := make([]byte, directMeasurementSize)
+	binary.BigEndian.PutUint32(value[0:], d.SenderTxC)
+	binary.BigEndian.PutUint32(value[4:], d.ReflectorRxC)
+	binary.BigEndian.PutUint32(value[8:], d.ReflectorTxC)
+	return TLV{Type: TLVDirectMeasurement, Value: value}
+}
+
+func DecodeDirectMeasurement(t TLV) (*DirectMeasurement, error) {
+	if len(t.Value) < directMeasurementSize {
+		return nil, errTLVSize(t.Type, len(t.Value), directMeasurementSize)
+	}
+	return &DirectMeasurement{
+		SenderTxC:    binary.BigEndian.Uint32(t.Value[0:]),
+		ReflectorRxC: binary.BigEndian.Uint32(t.Value[4:]),
+		ReflectorTxC: binary.BigEndian.Uint32(t.Value[8:]),
+	}, nil
+}
+
+/*
+Access Report TLV: the Session-Sender reports the state of an access network.
+*/
+type AccessReport struct {
+	ID         byte // Access ID, 4 bits
+	ReturnCode byte
+}
+
+func (a *AccessReport) TLV() TLV {
+	value := make([]byte, accessReportSize)
+	value[0] = a.ID << 4
+	value[1] = a.ReturnCode
+	return TLV{Type: TLVAccessReport, Value: value}
+}
+
+func DecodeAccessReport(t TLV) (*AccessReport, error) {
+	if len(t.Value) < accessReportSize {
+		return nil, errTLVSize(t.Type, len(t.Value), accessReportSize)
+	}
+	return &AccessReport{ID: t.Value[0] >> 4, ReturnCode: t.Value[1]}, nil
+}
+
+/*
+Follow-Up Telemetry TLV: Sequence Number and transmit timestamp of the packet the
+Session-Reflector reflected before this one in the same session.
+*/
+type FollowUpTelemetry struct {
+	Sequence      uint32
+	Timestamp     common.TwampTimestamp
+	TimestampMode byte
+}
+
+func (f *FollowUpTelemetry) TLV() TLV {
+	value := make([]byte, followUpTelemetrySize)
+	binary.BigEndian.PutUint32(value[0:], f.Sequence)
+	binary.BigEndian.PutUint32(value[4:], f.Timestamp.Integer)
+	binary.BigEndian.PutUint32(value[8:], f.Timestamp.Fraction)
+	value[12] = f.TimestampMode
+	return TLV{Type: TLVFollowUpTelemetry, Value: value}
+}
+
+func DecodeFollowUpTelemetry(t TLV) (*FollowUpTelemetry, error) {
+	if len(t.Value) < followUpTelemetrySize {
+		return nil, errTLVSize(t.Type, len(t.Value), followUpTelemetrySize)
+	}
+	return &FollowUpTelemetry{
+		Sequence: binary.BigEndian.Uint32(t.Value[0:]),
+		Timestamp: common.TwampTimestamp{
+			Integer:  binary.BigEndian.Uint32(t.Value[4:]),
+			Fraction: binary.BigEndian.Uint32(t.Value[8:]),
+		},
+		TimestampMode: t.Value[12],
+	}, nil
+}
+
+/*
+Create an HMAC TLV. It must be the last TLV; its value is computed when the
+packet is sent.
+*/
+func NewHMACTLV() TLV {
+	return TLV{Type: TLVHMAC, Value: make([]byte, hmacSize)}
+}
+
+/*
+Compute the HMAC TLV value: HMAC-SHA-256 truncated to 128 bits over the Sequence
+Number of the base packet and the TLVs preceding the HMAC TLV (RFC 8972 section 4.8).
+*/
+func computeTLVHMAC(key []byte, sequence []byte, tlvs []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(sequence[:4])
+	mac.Write(tlvs)
+	return mac.Sum(nil)[:hmacSize]
+}
+
+/*
+Find the value of the HMAC TLV in the encoded TLVs and the offset of its header.
+*/
+func findHMAC(tlvs []byte) (int, []byte) {
+	for offset := 0; offset+tlvHeaderSize <= len(tlvs); {
+		length := int(binary.BigEndian.Uint16(tlvs[offset+2:]))
+		if offset+tlvHeaderSize+length > len(tlvs) {
+			return -1, nil
+		}
+		if tlvs[offset+1] == TLVHMAC && length == hmacSize {
+			return offset, tlvs[offset+tlvHeaderSize : offset+tlvHeaderSize+length]
+		}
+		offset += tlvHeaderSize + length
+	}
+	return -1, nil
+}
+
+/*
+Sign a packet: compute the value of its HMAC TLV, if any, in place.
+*/
+func signTLVs(key []byte, pdu []byte, headerSize int) {
+	offset, value := findHMAC(pdu[headerSize:])
+	if value == nil {
+		return
+	}
+	copy(value, computeTLVHMAC(key, pdu, pdu[headerSize:headerSize+offset]))
+}
+
+/*
+Verify the HMAC TLV of a packet. Packets without HMAC TLV are accepted.
+*/
+func verifyTLVs(key []byte, pdu []byte, headerSize int) bool {
+	offset, value := findHMAC(pdu[headerSize:])
+	if value == nil {
+		return true
+	}
+	return hmac.Equal(value, computeTLVHMAC(key, pdu, pdu[headerSize:headerSize+offset]))
+}
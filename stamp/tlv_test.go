@@ -0,0 +1,189 @@
+package stamp
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/halacs/twamp/common"
+)
+
+func TestEncodeTLVs(t *testing.T) {
+	tlvs := []TLV{
+		{Type: TLVExtraPadding, Value: []byte{0, 0}},
+		{Flags: TLVFlagUnrecognized, Type: 200, Value: []byte{1, 2, 3}},
+		{Type: TLVHMAC, Value: []byte{}},
+	}
+
+	// RFC 8972 section 4: Flags, Type, Length and Value of each TLV
+	expected := []byte{
+		0x00, TLVExtraPadding, 0x00, 0x02, 0, 0,
+		0x80, 200, 0x00, 0x03, 1, 2, 3,
+		0x00, TLVHMAC, 0x00, 0x00,
+	}
+
+	buf := EncodeTLVs(tlvs)
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("encoded %x, expected %x", buf, expected)
+	}
+
+	decoded, err := DecodeTLVs(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, tlvs) {
+		t.Errorf("decoded %v, expected %v", decoded, tlvs)
+	}
+}
+
+func TestDecodeTLVsMalformed(t *testing.T) {
+	valid := []byte{0x00, TLVExtraPadding, 0x00, 0x01, 0}
+
+	tests := []struct {
+		name      string
+		buf       []byte
+		decoded   int // TLVs decoded before the malformed one
+		malformed bool
+	}{
+		{"empty", []byte{}, 0, false},
+		{"truncated header", []byte{0x00, TLVExtraPadding, 0x00}, 0, true},
+		{"truncated header after a TLV", append(append([]byte{}, valid...), 0x00), 1, true},
+		{"value overrun", []byte{0x00, TLVExtraPadding, 0x00, 0x04, 0, 0}, 0, true},
+		{"value overrun after a TLV", append(append([]byte{}, valid...), 0x00, TLVLocation, 0xff, 0xff), 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlvs, err := DecodeTLVs(test.buf)
+			if malformed := err != nil; malformed != test.malformed {
+				t.Errorf("malformed %v, expected %v: %v", malformed, test.malformed, err)
+			}
+			if len(tlvs) != test.decoded {
+				t.Errorf("decoded %d TLVs, expected %d", len(tlvs), test.decoded)
+			}
+		})
+	}
+}
+
+func TestTypedTLVRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{ TLV() TLV }
+		decode func(TLV) (interface{}, error)
+	}{
+		{"timestamp information", &TimestampInfo{SyncSourceNTP, TimestampSoftware, SyncSourcePTP, TimestampHardware},
+			func(t TLV) (interface{}, error) { return DecodeTimestampInfo(t) }},
+		{"class of service", &ClassOfService{DSCP1: 46, DSCP2: 63, ECN: 3, RP: 1},
+			func(t TLV) (interface{}, error) { return DecodeClassOfService(t) }},
+		{"direct measurement", &DirectMeasurement{SenderTxC: 1, ReflectorRxC: 0x80000000, ReflectorTxC: 0xffffffff},
+			func(t TLV) (interface{}, error) { return DecodeDirectMeasurement(t) }},
+		{"access report", &AccessReport{ID: 15, ReturnCode: 1},
+			func(t TLV) (interface{}, error) { return DecodeAccessReport(t) }},
+		{"follow-up telemetry", &FollowUpTelemetry{Sequence: 7, Timestamp: common.TwampTimestamp{Integer: 1, Fraction: 0xffffffff}, TimestampMode: TimestampSoftware},
+			func(t TLV) (interface{}, error) { return DecodeFollowUpTelemetry(t) }},
+		{"location", &Location{DestinationPort: 862, SourcePort: 40000, DestinationAddress: net.IPv4(192, 0, 2, 1).To4(), SourceAddress: net.ParseIP("2001:db8::1")},
+			func(t TLV) (interface{}, error) { return DecodeLocation(t) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlvs, err := DecodeTLVs(EncodeTLVs([]TLV{test.value.TLV()}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tlvs) != 1 {
+				t.Fatalf("decoded %d TLVs, expected 1", len(tlvs))
+			}
+
+			decoded, err := test.decode(tlvs[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.value) {
+				t.Errorf("decoded %+v, expected %+v", decoded, test.value)
+			}
+
+			short := TLV{Type: tlvs[0].Type, Value: tlvs[0].Value[:3]}
+			if _, err := test.decode(short); err == nil {
+				t.Error("decoded a short TLV, expected an error")
+			}
+		})
+	}
+}
+
+func TestClassOfServiceLayout(t *testing.T) {
+	// RFC 8972 section 4.4: DSCP1 (6 bits), DSCP2 (6 bits), ECN (2 bits), RP (2 bits)
+	tlv := (&ClassOfService{DSCP1: 0x2e, DSCP2: 0x0a, ECN: 0x02, RP: 0x01}).TLV()
+	expected := []byte{0xb8, 0xa9, 0x00, 0x00}
+	if !bytes.Equal(tlv.Value, expected) {
+		t.Errorf("encoded %x, expected %x", tlv.Value, expected)
+	}
+}
+
+func TestFillLocation(t *testing.T) {
+	value := NewLocationTLV(false).Value
+	value = append(value, EncodeTLVs([]TLV{{Type: 100, Value: []byte{0, 0}}})...)
+
+	source := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7), Port: 40000}
+	destination := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 862}
+	if err := fillLocation(value, source, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := DecodeLocation(TLV{Type: TLVLocation, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.DestinationPort != 862 || location.SourcePort != 40000 ||
+		!location.DestinationAddress.Equal(destination.IP) || !location.SourceAddress.Equal(source.IP) {
+		t.Errorf("filled %+v, expected %s to %s", location, source, destination)
+	}
+
+	subTLVs, err := DecodeTLVs(value[locationHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subTLVs[2].Flags&TLVFlagUnrecognized == 0 {
+		t.Error("unknown sub-TLV not flagged as unrecognized")
+	}
+
+	truncated := append(NewLocationTLV(false).Value, 0x00)
+	if fillLocation(truncated, source, destination) == nil {
+		t.Error("truncated sub-TLV filled, expected an error")
+	}
+}
+
+func TestSignVerifyTLVs(t *testing.T) {
+	key := []byte("hmac key")
+	header := bytes.Repeat([]byte{0x01}, 44)
+	tlvs := EncodeTLVs([]TLV{NewExtraPaddingTLV(8), NewHMACTLV()})
+
+	tests := []struct {
+		name     string
+		tamper   func(pdu []byte)
+		verified bool
+	}{
+		{"signed", func(pdu []byte) {}, true},
+		{"tampered sequence", func(pdu []byte) { pdu[0] ^= 1 }, false},
+		{"tampered TLV", func(pdu []byte) { pdu[len(header)+tlvHeaderSize] ^= 1 }, false},
+		{"tampered HMAC", func(pdu []byte) { pdu[len(pdu)-1] ^= 1 }, false},
+		{"timestamp not covered", func(pdu []byte) { pdu[4] ^= 1 }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pdu := append(append([]byte{}, header...), tlvs...)
+			signTLVs(key, pdu, len(header))
+			test.tamper(pdu)
+
+			if verified := verifyTLVs(key, pdu, len(header)); verified != test.verified {
+				t.Errorf("verified %v, expected %v", verified, test.verified)
+			}
+		})
+	}
+
+	if !verifyTLVs(key, append(append([]byte{}, header...), EncodeTLVs([]TLV{NewExtraPaddingTLV(8)})...), len(header)) {
+		t.Error("packet without HMAC TLV rejected")
+	}
+}
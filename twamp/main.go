@@ -7,8 +7,69 @@ import (
 	"github.com/halacs/twamp/full"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+/*
+Parse a comma separated list of security modes in order of preference.
+*/
+func parseModes(list string) (uint32, []uint32, error) {
+	names := map[string]uint32{
+		"unauthenticated": full.ModeUnauthenticated,
+		"authenticated":   full.ModeAuthenticated,
+		"encrypted":       full.ModeEncypted,
+		"mixed":           full.ModeMixed,
+	}
+
+	allowed := uint32(0)
+	preferred := []uint32{}
+	for _, name := range strings.Split(list, ",") {
+		mode, ok := names[strings.TrimSpace(name)]
+		if !ok {
+			return 0, nil, fmt.Errorf("unknown security mode: %s", name)
+		}
+		allowed |= mode
+		preferred = append(preferred, mode)
+	}
+
+	return allowed, preferred, nil
+}
+
+/*
+Parse a comma separated list of percentiles.
+*/
+func parsePercentiles(list string) ([]float64, error) {
+	percentiles := []float64{}
+	for _, value := range strings.Split(list, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile: %s", value)
+		}
+		percentiles = append(percentiles, p)
+	}
+
+	return percentiles, nil
+}
+
+/*
+Parse a comma separated list of increasing histogram bucket bounds in milliseconds.
+*/
+func parseHistogramBounds(list string) ([]time.Duration, error) {
+	bounds := []time.Duration{}
+	for _, value := range strings.Split(list, ",") {
+		ms, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		bound := time.Duration(ms * float64(time.Millisecond))
+		if err != nil || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+			return nil, fmt.Errorf("invalid histogram bound: %s", value)
+		}
+		bounds = append(bounds, bound)
+	}
+
+	return bounds, nil
+}
+
 func main() {
 	controlPort := flag.Int("cport", 862, "TWAMP TCP control port")
 	interval := flag.Int("interval", 1, "Interval between TWAMP-test requests (seconds)")
@@ -17,11 +78,43 @@ func main() {
 	size := flag.Int("size", 42, "Size of request packets (0..65468 bytes)")
 	tos := flag.Int("tos", 0, "IP type-of-service value (0..255)")
 	wait := flag.Int("wait", 1, "Maximum wait time after sending final packet (seconds)")
-	senderReceiverPort := flag.Int("senderReceiverPort", 6666, "UDP senderReceiverPort to send request packets")
+	senderPort := flag.Int("senderPort", 0, "Local UDP port to send request packets from (0 picks a free port)")
+	receiverPort := flag.Int("receiverPort", 6666, "UDP port the reflector is requested to receive request packets on")
 	mode := flag.String("mode", "ping", "Mode of operation (ping, json)")
+	keyID := flag.String("keyid", "", "KeyID used in authenticated, encrypted and mixed modes")
+	secret := flag.String("secret", "", "Shared secret (passphrase) used in authenticated, encrypted and mixed modes")
+	symmetrical := flag.Bool("symmetrical", false, "Request reflected packets of the same size as the sent ones (RFC 6038)")
+	reflectPadding := flag.Int("reflect-padding", 0, "Number of padding bytes the reflector returns for integrity checking (RFC 6038)")
+	clockSource := flag.String("clock", "none", "Source of the clock synchronization status sent in the Error Estimate (none, kernel, ntpd)")
+	kernelTimestamps := flag.Bool("kernel-timestamps", false, "Timestamp the reflected packets in the kernel (SO_TIMESTAMPNS, Linux only)")
+	ptp := flag.Bool("ptp", false, "Send timestamps in the IEEE 1588 PTP truncated format instead of NTP (RFC 8186)")
+	percentiles := flag.String("percentiles", "50,90,95,99,99.9", "Percentiles of the delays in the statistics")
+	histogram := flag.String("histogram", "0.1,0.2,0.5,1,2,5,10,20,50,100,200,500,1000", "Upper bounds of the delay histogram buckets (milliseconds)")
+	keepResults := flag.Int("keep-results", common.KeepAllResults, "Results listed in json mode: all (0), none (-1) or the given number of the last ones")
+	securityModes := flag.String("modes", "encrypted,authenticated,mixed,unauthenticated", "Allowed security modes in order of preference")
 
 	flag.Parse()
 
+	timestampFormat := common.TimestampNTP
+	if *ptp {
+		timestampFormat = common.TimestampPTP
+	}
+
+	clock, err := common.NewClockSource(*clockSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	common.SetClockSource(clock)
+
+	percentileList, err := parsePercentiles(*percentiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	histogramBounds, err := parseHistogramBounds(*histogram)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	args := flag.Args()
 
 	if len(args) < 1 {
@@ -32,6 +125,14 @@ func main() {
 	remoteIP := args[0]
 
 	client := full.NewFullClient()
+	if *secret != "" {
+		client.SetSharedSecret(*keyID, []byte(*secret))
+	}
+	allowed, preferred, err := parseModes(*securityModes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client.SetModePolicy(allowed, preferred...)
 	connection, err := client.Connect(remoteIP, *controlPort)
 	if err != nil {
 		log.Fatal(err)
@@ -39,11 +140,20 @@ func main() {
 
 	session, err := connection.CreateFullSession(
 		common.TwampSessionConfig{
-			SenderPort:   *senderReceiverPort,
-			ReceiverPort: *senderReceiverPort,
+			SenderPort:   *senderPort,
+			ReceiverPort: *receiverPort,
 			Timeout:      *wait,
 			Padding:      *size,
 			TOS:          *tos,
+			Interval:     time.Duration(*interval) * time.Second,
+
+			PaddingToReflect: *reflectPadding,
+			SymmetricalSize:  *symmetrical,
+			TimestampFormat:  timestampFormat,
+			KernelTimestamps: *kernelTimestamps,
+			KeepResults:      *keepResults,
+			Percentiles:      percentileList,
+			HistogramBounds:  histogramBounds,
 		},
 	)
 	if err != nil {
@@ -57,7 +167,7 @@ func main() {
 
 	switch *mode {
 	case "json":
-		results := test.RunX(*count, func(result *common.TwampResult) {})
+		results := test.RunX(*count, nil, nil)
 		test.FormatJSON(results)
 	case "ping":
 		test.Ping(*count, *rapid, *interval)
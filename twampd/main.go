@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"github.com/halacs/twamp/common"
+	"github.com/halacs/twamp/full"
+	"github.com/halacs/twamp/light"
+	"github.com/halacs/twamp/stamp"
+	"log"
+)
+
+func main() {
+	address := flag.String("address", "", "Local address to listen on (default all addresses)")
+	controlPort := flag.Int("cport", 862, "TWAMP TCP control port")
+	keyID := flag.String("keyid", "", "KeyID accepted in authenticated, encrypted and mixed modes")
+	secret := flag.String("secret", "", "Shared secret (passphrase) belonging to the KeyID")
+	lightMode := flag.Bool("light", false, "Run a TWAMP Light reflector instead of a TWAMP server")
+	port := flag.Int("port", 862, "UDP port of the TWAMP Light or STAMP reflector")
+	stateful := flag.Bool("stateful", false, "Keep a Sequence Number per sender in the TWAMP Light or STAMP reflector")
+	clockSource := flag.String("clock", "none", "Source of the clock synchronization status sent in the Error Estimate (none, kernel, ntpd)")
+	ptp := flag.Bool("ptp", false, "Reflect timestamps in the IEEE 1588 PTP truncated format instead of NTP (RFC 8186)")
+	stampMode := flag.Bool("stamp", false, "Run a STAMP reflector, which also reflects TWAMP Light, instead of a TWAMP server")
+
+	flag.Parse()
+
+	timestampFormat := common.TimestampNTP
+	if *ptp {
+		timestampFormat = common.TimestampPTP
+	}
+
+	clock, err := common.NewClockSource(*clockSource)
+	if err != nil {
+		log.Fatal(err)
+	}
+	common.SetClockSource(clock)
+
+	if *stampMode {
+		reflector, err := stamp.NewReflector(*address, *port, *stateful)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		reflector.SetTimestampFormat(timestampFormat)
+		log.Printf("STAMP reflector listening on %s\n", reflector.Addr())
+		log.Fatal(reflector.Serve())
+	}
+
+	if *lightMode {
+		reflector, err := light.NewReflector(*address, *port, *stateful)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		reflector.SetTimestampFormat(timestampFormat)
+		log.Printf("TWAMP Light reflector listening on %s\n", reflector.Addr())
+		log.Fatal(reflector.Serve())
+	}
+
+	server := full.NewFullServer()
+	server.SetTimestampFormat(timestampFormat)
+	if *secret != "" {
+		server.AddSharedSecret(*keyID, []byte(*secret))
+	}
+
+	err = server.Listen(*address, *controlPort)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("TWAMP server listening on %s\n", server.Addr())
+	log.Fatal(server.Serve())
+}